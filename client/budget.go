@@ -0,0 +1,161 @@
+package client
+
+import (
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/MariusVanDerWijden/ShareMyRPC/raiden"
+)
+
+// Budget limits the tokens the client spends on calls.
+// Limits that are nil are not enforced.
+type Budget struct {
+	Session   *raiden.Amount            // total spent by the client
+	PerMinute *raiden.Amount            // spent within any minute
+	Methods   map[string]*raiden.Amount // total spent per JSON-RPC method
+}
+
+// copy returns a deep copy of the budget.
+func (b *Budget) copy() Budget {
+	cpy := Budget{Session: b.Session, PerMinute: b.PerMinute}
+	if b.Methods != nil {
+		cpy.Methods = make(map[string]*raiden.Amount, len(b.Methods))
+		for method, limit := range b.Methods {
+			cpy.Methods[method] = limit
+		}
+	}
+	return cpy
+}
+
+// spending tracks the tokens spent by the client against its budget.
+type spending struct {
+	lock    sync.Mutex
+	budget  Budget
+	total   *big.Int
+	methods map[string]*big.Int
+	recent  []*spend // spent within the last minute, oldest first
+}
+
+type spend struct {
+	time    time.Time
+	amount  *big.Int
+	methods map[string]*big.Int
+}
+
+func newSpending() *spending {
+	return &spending{
+		total:   new(big.Int),
+		methods: make(map[string]*big.Int),
+	}
+}
+
+// reserve books the costs of one payment, keyed by JSON-RPC method,
+// if they fit into the budget. Costs that are not tied to a method
+// are keyed by the empty string.
+func (s *spending) reserve(costs map[string]*big.Int, now time.Time) (*spend, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	amount := new(big.Int)
+	for _, cost := range costs {
+		amount.Add(amount, cost)
+	}
+	// Forget what was spent more than a minute ago
+	for len(s.recent) > 0 && now.Sub(s.recent[0].time) >= time.Minute {
+		s.recent = s.recent[1:]
+	}
+	if exceeds(s.total, amount, s.budget.Session) {
+		return nil, fmt.Errorf("%w: session cap of %v", ErrBudgetExceeded, s.budget.Session)
+	}
+	if s.budget.PerMinute != nil {
+		lastMinute := new(big.Int)
+		for _, sp := range s.recent {
+			lastMinute.Add(lastMinute, sp.amount)
+		}
+		if exceeds(lastMinute, amount, s.budget.PerMinute) {
+			return nil, fmt.Errorf("%w: cap of %v per minute", ErrBudgetExceeded, s.budget.PerMinute)
+		}
+	}
+	for method, cost := range costs {
+		if method == "" {
+			continue
+		}
+		spent := s.methods[method]
+		if spent == nil {
+			spent = new(big.Int)
+		}
+		if exceeds(spent, cost, s.budget.Methods[method]) {
+			return nil, fmt.Errorf("%w: cap of %v for %s", ErrBudgetExceeded, s.budget.Methods[method], method)
+		}
+	}
+	sp := &spend{time: now, amount: amount, methods: costs}
+	s.total.Add(s.total, amount)
+	for method, cost := range costs {
+		if s.methods[method] == nil {
+			s.methods[method] = new(big.Int)
+		}
+		s.methods[method].Add(s.methods[method], cost)
+	}
+	s.recent = append(s.recent, sp)
+	return sp, nil
+}
+
+// release gives back a reservation whose payment failed.
+func (s *spending) release(sp *spend) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.total.Sub(s.total, sp.amount)
+	for method, cost := range sp.methods {
+		s.methods[method].Sub(s.methods[method], cost)
+	}
+	for i, recent := range s.recent {
+		if recent == sp {
+			s.recent = append(s.recent[:i], s.recent[i+1:]...)
+			break
+		}
+	}
+}
+
+// refund gives back tokens the peer refunded for failed calls.
+func (s *spending) refund(amount *big.Int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.total.Sub(s.total, amount)
+	if s.total.Sign() < 0 {
+		s.total.SetInt64(0)
+	}
+}
+
+// exceeds returns true if spending amount on top of spent goes over limit.
+func exceeds(spent, amount *big.Int, limit *raiden.Amount) bool {
+	if limit == nil {
+		return false
+	}
+	return new(big.Int).Add(spent, amount).Cmp(limit.Int()) > 0
+}
+
+// SetBudget replaces the budget of the client. The tokens spent so far
+// count against the new budget.
+func (ec *Client) SetBudget(budget Budget) {
+	ec.spending.lock.Lock()
+	defer ec.spending.lock.Unlock()
+	ec.spending.budget = budget.copy()
+}
+
+// Budget returns the budget of the client.
+func (ec *Client) Budget() Budget {
+	ec.spending.lock.Lock()
+	defer ec.spending.lock.Unlock()
+	return ec.spending.budget.copy()
+}
+
+// Spent returns the tokens the client spent on calls in total.
+func (ec *Client) Spent() *raiden.Amount {
+	ec.spending.lock.Lock()
+	defer ec.spending.lock.Unlock()
+	return raiden.NewAmount(ec.spending.total)
+}
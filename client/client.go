@@ -2,235 +2,736 @@ package client
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/MariusVanDerWijden/ShareMyRPC/pricing"
 	"github.com/MariusVanDerWijden/ShareMyRPC/raiden"
+	"github.com/MariusVanDerWijden/ShareMyRPC/server"
 	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethclient"
-	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/event"
+	"github.com/ethereum/go-ethereum/rpc"
 )
 
+var offerTimeout = 10 * time.Second
+
+var errNoRPC = errors.New("client has no raw rpc connection")
+
+// Client can be used as backend of contract bindings and chain readers.
 var (
-	generalCost         = 4
-	stateAccessCost     = 5
-	filterCost          = 8
-	contractCallingCost = 3
-	estimateGasCost     = 2
-	sendTransactionCost = 1
+	_ bind.ContractBackend           = (*Client)(nil)
+	_ bind.DeployBackend             = (*Client)(nil)
+	_ bind.PendingContractCaller     = (*Client)(nil)
+	_ ethereum.ChainReader           = (*Client)(nil)
+	_ ethereum.TransactionReader     = (*Client)(nil)
+	_ ethereum.ChainStateReader      = (*Client)(nil)
+	_ ethereum.ChainSyncReader       = (*Client)(nil)
+	_ ethereum.ContractCaller        = (*Client)(nil)
+	_ ethereum.LogFilterer           = (*Client)(nil)
+	_ ethereum.TransactionSender     = (*Client)(nil)
+	_ ethereum.GasPricer             = (*Client)(nil)
+	_ ethereum.PendingStateReader    = (*Client)(nil)
+	_ ethereum.PendingContractCaller = (*Client)(nil)
+	_ ethereum.GasEstimator          = (*Client)(nil)
 )
 
 // Client is a thin wrapper around an ethclient object.
+// It is safe for concurrent use.
 type Client struct {
-	c     *ethclient.Client
-	r     *raiden.Raiden
-	token string
-	other string
+	c        *ethclient.Client
+	rpc      *rpc.Client // underlying connection, nil if unknown
+	r        *raiden.Raiden
+	offer    *pricing.Offer
+	address  string  // raiden address of the client, empty if unknown
+	byPayer  bool    // the peer takes the price of calls from the payments of address
+	polling  bool    // the connection can not deliver notifications
+	credit   *credit // prepaid balance, nil if every call is paid for
+	debt     *debt   // unpaid calls, nil if every call is paid for
+	spending *spending
+	ledger   Ledger
+
+	payments  chan *payment // queue of the payments to make
+	quit      chan struct{}
+	closeOnce sync.Once
+
+	lock     sync.Mutex
+	token    string
+	other    string
+	schedule *pricing.Schedule
+	refunds  *big.Int      // refunds of failed calls that were not spent yet
+	paused   chan struct{} // closed when a pending deposit is done, nil if none
 }
 
 func NewClient(c *ethclient.Client, r *raiden.Raiden) *Client {
-	return &Client{
-		c: c,
-		r: r,
+	ec := &Client{
+		c:        c,
+		r:        r,
+		schedule: pricing.DefaultSchedule(),
+		refunds:  new(big.Int),
+		spending: newSpending(),
+		ledger:   NewMemoryLedger(),
+		payments: make(chan *payment),
+		quit:     make(chan struct{}),
+	}
+	go ec.payLoop()
+	return ec
+}
+
+// NewClientFromURL connects to the node at clientURL and the raiden node at raidenURL.
+// It fails if the raiden node is not ready to make payments. If the peer at
+// clientURL publishes its prices, the client pays by them, in the token
+// and to the raiden address the peer published.
+func NewClientFromURL(clientURL, raidenURL string, opts ...Option) (*Client, error) {
+	cfg := newConfig(opts)
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	r := raiden.NewRaiden(raidenURL, cfg.raidenOpts...)
+	if err := r.CheckReady(context.Background(), cfg.address); err != nil {
+		return nil, err
+	}
+	address, err := r.Address()
+	if err != nil {
+		return nil, err
+	}
+	// Calls are tied to their payments by identifier, unless the peer takes
+	// their price from the payments of our raiden address
+	byPayer := cfg.payByAddress || cfg.topUp != nil || cfg.postpaid || !isHTTP(clientURL)
+	var payer string
+	if byPayer {
+		payer = address
+	}
+	t := new(transport)
+	rc, err := dial(clientURL, payer, t)
+	if err != nil {
+		return nil, err
+	}
+	client := NewClient(ethclient.NewClient(rc), r)
+	client.rpc = rc
+	client.address = address
+	client.byPayer = byPayer
+	client.polling = isHTTP(clientURL)
+	t.client = client
+	if cfg.schedule != nil {
+		client.SetSchedule(cfg.schedule)
+	}
+	if cfg.budget != nil {
+		client.SetBudget(*cfg.budget)
+	}
+	if cfg.ledger != nil {
+		client.ledger = cfg.ledger
+	}
+	// Learn the prices of the peer before paying anything
+	offer, err := fetchOffer(rc)
+	switch {
+	case err == nil:
+		if cfg.maxPrices != nil {
+			if method, ok := offer.Schedule.Exceeds(cfg.maxPrices); ok {
+				client.Close()
+				if method == pricing.PeriodLimit {
+					return nil, fmt.Errorf("%w: subscription period of %vs is too short", ErrPricesTooHigh, offer.Schedule.Period)
+				}
+				return nil, fmt.Errorf("%w: price of %q is too high", ErrPricesTooHigh, method)
+			}
+		}
+		client.offer = offer
+		client.SetSchedule(offer.Schedule)
+		client.Init(offer.Token, offer.Address)
+	case cfg.maxPrices != nil:
+		client.Close()
+		return nil, fmt.Errorf("could not fetch prices: %w", err)
 	}
+	if cfg.topUp != nil {
+		client.credit = &credit{
+			topUp:     new(big.Int).Set(cfg.topUp.Int()),
+			threshold: new(big.Int).Set(cfg.threshold.Int()),
+			balance:   new(big.Int),
+		}
+	}
+	if cfg.postpaid {
+		client.debt = &debt{
+			calls:  cfg.settleCalls,
+			amount: new(big.Int),
+		}
+		if cfg.settlePeriod > 0 {
+			go client.settleLoop(cfg.settlePeriod)
+		}
+	}
+	return client, nil
 }
 
-func NewClientFromURL(clientURL, raidenURL string) (*Client, error) {
-	c, err := ethclient.Dial(clientURL)
+// dial connects to the node at rawurl on behalf of the raiden address payer.
+// Refunds are only noticed over HTTP.
+// isHTTP returns true if rawurl is dialed over http, which does not
+// support subscriptions.
+func isHTTP(rawurl string) bool {
+	u, err := url.Parse(rawurl)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https")
+}
+
+// dial connects to the peer at rawurl. If payer is not empty, it is passed
+// to the peer as the raiden address that pays the calls.
+func dial(rawurl, payer string, t *transport) (*rpc.Client, error) {
+	u, err := url.Parse(rawurl)
 	if err != nil {
 		return nil, err
 	}
-	r := raiden.NewRaiden(raidenURL)
-	return NewClient(c, r), nil
+	switch {
+	case u.Scheme == "http" || u.Scheme == "https":
+		rc, err := rpc.DialHTTPWithClient(rawurl, &http.Client{Transport: t})
+		if err != nil {
+			return nil, err
+		}
+		if payer != "" {
+			rc.SetHeader(server.PayerHeader, payer)
+		}
+		return rc, nil
+	case payer != "" && (u.Scheme == "ws" || u.Scheme == "wss"):
+		// Headers are not sent with the websocket handshake
+		query := u.Query()
+		query.Set(server.PayerParam, payer)
+		u.RawQuery = query.Encode()
+		return rpc.Dial(u.String())
+	}
+	return rpc.Dial(rawurl)
 }
 
+// fetchOffer retrieves the prices of the peer.
+func fetchOffer(rc *rpc.Client) (*pricing.Offer, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), offerTimeout)
+	defer cancel()
+	offer := new(pricing.Offer)
+	if err := rc.CallContext(ctx, offer, server.PricesMethod); err != nil {
+		return nil, err
+	}
+	if offer.Schedule == nil {
+		return nil, errors.New("no price schedule")
+	}
+	if err := offer.Schedule.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid price schedule: %w", err)
+	}
+	return offer, nil
+}
+
+// Offer returns the prices the peer published when the client connected,
+// or nil if the peer did not publish any.
+func (ec *Client) Offer() *pricing.Offer {
+	return ec.offer
+}
+
+// Init sets the token the client pays in and the raiden address of the peer.
 func (ec *Client) Init(token, peer string) {
+	ec.lock.Lock()
+	defer ec.lock.Unlock()
 	ec.token = token
 	ec.other = peer
 }
 
-// Close closes the connection to the peer.
+// peer returns the token the client pays in and the raiden address of the peer.
+func (ec *Client) peer() (string, string) {
+	ec.lock.Lock()
+	defer ec.lock.Unlock()
+	return ec.token, ec.other
+}
+
+// Close closes the connection to the peer and stops making payments.
 func (ec *Client) Close() {
-	ec.c.Close()
+	ec.closeOnce.Do(func() {
+		close(ec.quit)
+		ec.c.Close()
+	})
+}
+
+// SetSchedule sets the price schedule the client pays by.
+func (ec *Client) SetSchedule(schedule *pricing.Schedule) {
+	ec.lock.Lock()
+	defer ec.lock.Unlock()
+	ec.schedule = schedule
+}
+
+// prices returns the price schedule the client pays by.
+func (ec *Client) prices() *pricing.Schedule {
+	ec.lock.Lock()
+	defer ec.lock.Unlock()
+	return ec.schedule
+}
+
+// payFor pays the prices of the JSON-RPC methods to the peer in a single
+// payment. The returned context passes the identifier of the payment to the
+// peer with the calls made with it. The error of the call has to be passed
+// to done, which returns it.
+func (ec *Client) payFor(ctx context.Context, methods ...string) (_ context.Context, done func(error) error, err error) {
+	schedule := ec.prices()
+	costs := make(map[string]*big.Int)
+	for _, method := range methods {
+		if costs[method] == nil {
+			costs[method] = new(big.Int)
+		}
+		costs[method].Add(costs[method], schedule.Price(method).Int())
+	}
+	call, err := ec.charge(ctx, strings.Join(methods, ","), costs)
+	if err != nil {
+		return ctx, nil, err
+	}
+	done = func(err error) error {
+		ec.finish(call, err)
+		return err
+	}
+	return context.WithValue(ctx, paymentKey{}, call), done, nil
 }
 
-// Send sends some money to the peer.
-func (ec *Client) Send(amount int) {
-	am := fmt.Sprintf("%v", amount*int(params.Ether))
-	msg, err := ec.r.PayToken(ec.token, ec.other, am)
+// paidCall is a call the client paid for, or is going to pay for.
+type paidCall struct {
+	id       raiden.PaymentID // identifier of the payment, 0 if none was made
+	status   int              // HTTP status of the answer of the peer, 0 if unknown
+	postpaid *postpaidCall    // cost that is owed once the call was served, nil if paid
+}
+
+// Send sends some money to the peer. If the peer pays the calls of the
+// client from the payments of its address, see WithPayerAddress, it spends
+// the money on the next calls of the client. In prepaid mode the amount is
+// debited from the credit of the client instead.
+// A failed payment is reported as an error matching ErrPaymentFailed,
+// a payment over the budget as one matching ErrBudgetExceeded.
+func (ec *Client) Send(amount *raiden.Amount) error {
+	call, err := ec.charge(context.Background(), "", map[string]*big.Int{"": amount.Int()})
+	if err != nil {
+		return err
+	}
+	ec.finish(call, nil)
+	return nil
+}
+
+// charge pays the costs, keyed by JSON-RPC method, if they fit into the
+// budget of the client. The payment is recorded under label. In postpaid
+// mode the costs are only reserved in the budget, they are added to the
+// debt once the call is finished.
+func (ec *Client) charge(ctx context.Context, label string, costs map[string]*big.Int) (*paidCall, error) {
+	call := new(paidCall)
+	amount := new(big.Int)
+	for _, cost := range costs {
+		amount.Add(amount, cost)
+	}
+	if amount.Sign() == 0 {
+		return call, nil
+	}
+	sp, err := ec.spending.reserve(costs, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if ec.debt != nil {
+		call.postpaid = &postpaidCall{label: label, amount: raiden.NewAmount(amount), reserved: sp}
+		return call, nil
+	}
+	call.id, err = ec.pay(ctx, label, raiden.NewAmount(amount))
+	if err != nil {
+		ec.spending.release(sp)
+		return nil, err
+	}
+	return call, nil
+}
+
+func (ec *Client) pay(ctx context.Context, method string, amount *raiden.Amount) (raiden.PaymentID, error) {
+	if amount.Int().Sign() == 0 {
+		return 0, nil
+	}
+	// The peer takes refunds of failed calls first, but only from calls
+	// paid by our address
+	if ec.byPayer {
+		if amount = ec.spendRefunds(method, amount); amount.Int().Sign() == 0 {
+			return 0, nil
+		}
+	}
+	if ec.credit != nil {
+		return 0, ec.spendCredit(ctx, method, amount)
+	}
+	if ec.debt != nil {
+		ec.accrue(method, amount)
+		return 0, nil
+	}
+	return ec.transfer(ctx, method, amount)
+}
+
+// newPaymentID returns a random non-zero payment identifier.
+func newPaymentID() (raiden.PaymentID, error) {
+	var buf [8]byte
+	for {
+		if _, err := rand.Read(buf[:]); err != nil {
+			return 0, err
+		}
+		if id := binary.BigEndian.Uint64(buf[:]); id != 0 {
+			return raiden.PaymentID(id), nil
+		}
+	}
+}
+
+// CallContext pays for and performs a JSON-RPC call with the given arguments.
+// It allows calling methods the client has no typed wrapper for.
+func (ec *Client) CallContext(ctx context.Context, result interface{}, method string, args ...interface{}) error {
+	if ec.rpc == nil {
+		return errNoRPC
+	}
+	ctx, done, err := ec.payFor(ctx, method)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	return done(ec.rpc.CallContext(ctx, result, method, args...))
+}
+
+// BatchCallContext pays for and sends all elements in a single request.
+// The prices of all elements are paid by a single payment.
+func (ec *Client) BatchCallContext(ctx context.Context, b []rpc.BatchElem) error {
+	if ec.rpc == nil {
+		return errNoRPC
 	}
-	if msg == "The method is not allowed for the requested URL." {
-		panic(msg)
+	methods := make([]string, len(b))
+	for i, elem := range b {
+		methods[i] = elem.Method
 	}
+	ctx, done, err := ec.payFor(ctx, methods...)
+	if err != nil {
+		return err
+	}
+	return done(ec.rpc.BatchCallContext(ctx, b))
 }
 
 // ChainID retrieves the current chain ID for transaction replay protection.
 func (ec *Client) ChainID(ctx context.Context) (*big.Int, error) {
-	return ec.c.ChainID(ctx)
+	ctx, done, err := ec.payFor(ctx, "eth_chainId")
+	if err != nil {
+		return nil, err
+	}
+	id, err := ec.c.ChainID(ctx)
+	return id, done(err)
 }
 
 // BlockByHash returns the given full block.
 func (ec *Client) BlockByHash(ctx context.Context, hash common.Hash) (*types.Block, error) {
-	ec.Send(generalCost)
-	return ec.c.BlockByHash(ctx, hash)
+	ctx, done, err := ec.payFor(ctx, "eth_getBlockByHash")
+	if err != nil {
+		return nil, err
+	}
+	block, err := ec.c.BlockByHash(ctx, hash)
+	return block, done(err)
 }
 
 // BlockByNumber returns a block from the current canonical chain. If number is nil, the
 // latest known block is returned.
 func (ec *Client) BlockByNumber(ctx context.Context, number *big.Int) (*types.Block, error) {
-	ec.Send(generalCost)
-	return ec.c.BlockByNumber(ctx, number)
+	ctx, done, err := ec.payFor(ctx, "eth_getBlockByNumber")
+	if err != nil {
+		return nil, err
+	}
+	block, err := ec.c.BlockByNumber(ctx, number)
+	return block, done(err)
 }
 
 // BlockNumber returns the most recent block number
 func (ec *Client) BlockNumber(ctx context.Context) (uint64, error) {
-	ec.Send(generalCost)
-	return ec.c.BlockNumber(ctx)
+	ctx, done, err := ec.payFor(ctx, "eth_blockNumber")
+	if err != nil {
+		return 0, err
+	}
+	number, err := ec.c.BlockNumber(ctx)
+	return number, done(err)
 }
 
 // HeaderByHash returns the block header with the given hash.
 func (ec *Client) HeaderByHash(ctx context.Context, hash common.Hash) (*types.Header, error) {
-	ec.Send(generalCost)
-	return ec.c.HeaderByHash(ctx, hash)
+	ctx, done, err := ec.payFor(ctx, "eth_getBlockByHash")
+	if err != nil {
+		return nil, err
+	}
+	header, err := ec.c.HeaderByHash(ctx, hash)
+	return header, done(err)
 }
 
 // HeaderByNumber returns a block header from the current canonical chain. If number is
 // nil, the latest known header is returned.
 func (ec *Client) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
-	ec.Send(generalCost)
-	return ec.c.HeaderByNumber(ctx, number)
+	ctx, done, err := ec.payFor(ctx, "eth_getBlockByNumber")
+	if err != nil {
+		return nil, err
+	}
+	header, err := ec.c.HeaderByNumber(ctx, number)
+	return header, done(err)
 }
 
 // TransactionByHash returns the transaction with the given hash.
 func (ec *Client) TransactionByHash(ctx context.Context, hash common.Hash) (tx *types.Transaction, isPending bool, err error) {
-	ec.Send(generalCost)
-	return ec.c.TransactionByHash(ctx, hash)
+	ctx, done, err := ec.payFor(ctx, "eth_getTransactionByHash")
+	if err != nil {
+		return nil, false, err
+	}
+	tx, isPending, err = ec.c.TransactionByHash(ctx, hash)
+	return tx, isPending, done(err)
 }
 
 // TransactionSender returns the sender address of the given transaction.
 func (ec *Client) TransactionSender(ctx context.Context, tx *types.Transaction, block common.Hash, index uint) (common.Address, error) {
-	ec.Send(generalCost)
-	return ec.c.TransactionSender(ctx, tx, block, index)
+	ctx, done, err := ec.payFor(ctx, "eth_getTransactionByBlockHashAndIndex")
+	if err != nil {
+		return common.Address{}, err
+	}
+	sender, err := ec.c.TransactionSender(ctx, tx, block, index)
+	return sender, done(err)
 }
 
 // TransactionCount returns the total number of transactions in the given block.
 func (ec *Client) TransactionCount(ctx context.Context, blockHash common.Hash) (uint, error) {
-	ec.Send(generalCost)
-	return ec.c.TransactionCount(ctx, blockHash)
+	ctx, done, err := ec.payFor(ctx, "eth_getBlockTransactionCountByHash")
+	if err != nil {
+		return 0, err
+	}
+	count, err := ec.c.TransactionCount(ctx, blockHash)
+	return count, done(err)
 }
 
 // TransactionInBlock returns a single transaction at index in the given block.
 func (ec *Client) TransactionInBlock(ctx context.Context, blockHash common.Hash, index uint) (*types.Transaction, error) {
-	ec.Send(generalCost)
-	return ec.c.TransactionInBlock(ctx, blockHash, index)
+	ctx, done, err := ec.payFor(ctx, "eth_getTransactionByBlockHashAndIndex")
+	if err != nil {
+		return nil, err
+	}
+	tx, err := ec.c.TransactionInBlock(ctx, blockHash, index)
+	return tx, done(err)
 }
 
 // TransactionReceipt returns the receipt of a transaction by transaction hash.
 // Note that the receipt is not available for pending transactions.
 func (ec *Client) TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error) {
-	ec.Send(generalCost)
-	return ec.c.TransactionReceipt(ctx, txHash)
+	ctx, done, err := ec.payFor(ctx, "eth_getTransactionReceipt")
+	if err != nil {
+		return nil, err
+	}
+	receipt, err := ec.c.TransactionReceipt(ctx, txHash)
+	return receipt, done(err)
 }
 
 // SyncProgress retrieves the current progress of the sync algorithm. If there's
 // no sync currently running, it returns nil.
 func (ec *Client) SyncProgress(ctx context.Context) (*ethereum.SyncProgress, error) {
-	ec.Send(generalCost)
-	return ec.c.SyncProgress(ctx)
+	ctx, done, err := ec.payFor(ctx, "eth_syncing")
+	if err != nil {
+		return nil, err
+	}
+	progress, err := ec.c.SyncProgress(ctx)
+	return progress, done(err)
 }
 
 // SubscribeNewHead subscribes to notifications about the current blockchain head
-// on the given channel.
+// on the given channel. The headers are paid for in the background as they are
+// delivered. If a payment fails, the subscription ends with its error.
 func (ec *Client) SubscribeNewHead(ctx context.Context, ch chan<- *types.Header) (ethereum.Subscription, error) {
-	ec.Send(generalCost)
-	return ec.c.SubscribeNewHead(ctx, ch)
+	ctx, done, err := ec.subscribe(ctx, "newHeads")
+	if err != nil {
+		return nil, err
+	}
+	headers := make(chan *types.Header)
+	sub, err := ec.c.SubscribeNewHead(ctx, headers)
+	if err := done(err); err != nil {
+		return nil, err
+	}
+	m := ec.newMeter("newHeads")
+	return event.NewSubscription(func(quit <-chan struct{}) error {
+		defer sub.Unsubscribe()
+		defer m.stop()
+		for {
+			select {
+			case header := <-headers:
+				select {
+				case ch <- header:
+				case <-quit:
+					return nil
+				}
+				if err := m.delivered(); err != nil {
+					return err
+				}
+			case <-m.period:
+				if err := m.renew(); err != nil {
+					return err
+				}
+			case err := <-sub.Err():
+				return err
+			case <-quit:
+				return nil
+			}
+		}
+	}), nil
 }
 
 // State Access
 
 // NetworkID returns the network ID (also known as the chain ID) for this chain.
 func (ec *Client) NetworkID(ctx context.Context) (*big.Int, error) {
-	ec.Send(stateAccessCost)
-	return ec.c.NetworkID(ctx)
+	ctx, done, err := ec.payFor(ctx, "net_version")
+	if err != nil {
+		return nil, err
+	}
+	id, err := ec.c.NetworkID(ctx)
+	return id, done(err)
 }
 
 // BalanceAt returns the wei balance of the given account.
 // The block number can be nil, in which case the balance is taken from the latest known block.
 func (ec *Client) BalanceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (*big.Int, error) {
-	ec.Send(stateAccessCost)
-	return ec.c.BalanceAt(ctx, account, blockNumber)
+	ctx, done, err := ec.payFor(ctx, "eth_getBalance")
+	if err != nil {
+		return nil, err
+	}
+	balance, err := ec.c.BalanceAt(ctx, account, blockNumber)
+	return balance, done(err)
 }
 
 // StorageAt returns the value of key in the contract storage of the given account.
 // The block number can be nil, in which case the value is taken from the latest known block.
 func (ec *Client) StorageAt(ctx context.Context, account common.Address, key common.Hash, blockNumber *big.Int) ([]byte, error) {
-	ec.Send(stateAccessCost)
-	return ec.c.StorageAt(ctx, account, key, blockNumber)
+	ctx, done, err := ec.payFor(ctx, "eth_getStorageAt")
+	if err != nil {
+		return nil, err
+	}
+	value, err := ec.c.StorageAt(ctx, account, key, blockNumber)
+	return value, done(err)
 }
 
 // CodeAt returns the contract code of the given account.
 // The block number can be nil, in which case the code is taken from the latest known block.
 func (ec *Client) CodeAt(ctx context.Context, account common.Address, blockNumber *big.Int) ([]byte, error) {
-	ec.Send(stateAccessCost)
-	return ec.c.CodeAt(ctx, account, blockNumber)
+	ctx, done, err := ec.payFor(ctx, "eth_getCode")
+	if err != nil {
+		return nil, err
+	}
+	code, err := ec.c.CodeAt(ctx, account, blockNumber)
+	return code, done(err)
 }
 
 // NonceAt returns the account nonce of the given account.
 // The block number can be nil, in which case the nonce is taken from the latest known block.
 func (ec *Client) NonceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (uint64, error) {
-	ec.Send(stateAccessCost)
-	return ec.c.NonceAt(ctx, account, blockNumber)
+	ctx, done, err := ec.payFor(ctx, "eth_getTransactionCount")
+	if err != nil {
+		return 0, err
+	}
+	nonce, err := ec.c.NonceAt(ctx, account, blockNumber)
+	return nonce, done(err)
 }
 
 // Filters
 
 // FilterLogs executes a filter query.
 func (ec *Client) FilterLogs(ctx context.Context, q ethereum.FilterQuery) ([]types.Log, error) {
-	ec.Send(filterCost)
-	return ec.c.FilterLogs(ctx, q)
+	ctx, done, err := ec.payFor(ctx, "eth_getLogs")
+	if err != nil {
+		return nil, err
+	}
+	logs, err := ec.c.FilterLogs(ctx, q)
+	return logs, done(err)
 }
 
 // SubscribeFilterLogs subscribes to the results of a streaming filter query.
+// The logs are paid for in the background as they are delivered. If a payment
+// fails, the subscription ends with its error.
 func (ec *Client) SubscribeFilterLogs(ctx context.Context, q ethereum.FilterQuery, ch chan<- types.Log) (ethereum.Subscription, error) {
-	ec.Send(filterCost)
-	return ec.c.SubscribeFilterLogs(ctx, q, ch)
+	ctx, done, err := ec.subscribe(ctx, "logs")
+	if err != nil {
+		return nil, err
+	}
+	logs := make(chan types.Log)
+	sub, err := ec.c.SubscribeFilterLogs(ctx, q, logs)
+	if err := done(err); err != nil {
+		return nil, err
+	}
+	m := ec.newMeter("logs")
+	return event.NewSubscription(func(quit <-chan struct{}) error {
+		defer sub.Unsubscribe()
+		defer m.stop()
+		for {
+			select {
+			case log := <-logs:
+				select {
+				case ch <- log:
+				case <-quit:
+					return nil
+				}
+				if err := m.delivered(); err != nil {
+					return err
+				}
+			case <-m.period:
+				if err := m.renew(); err != nil {
+					return err
+				}
+			case err := <-sub.Err():
+				return err
+			case <-quit:
+				return nil
+			}
+		}
+	}), nil
 }
 
 // Pending State
 
 // PendingBalanceAt returns the wei balance of the given account in the pending state.
 func (ec *Client) PendingBalanceAt(ctx context.Context, account common.Address) (*big.Int, error) {
-	ec.Send(stateAccessCost)
-	return ec.c.PendingBalanceAt(ctx, account)
+	ctx, done, err := ec.payFor(ctx, "eth_getBalance")
+	if err != nil {
+		return nil, err
+	}
+	balance, err := ec.c.PendingBalanceAt(ctx, account)
+	return balance, done(err)
 }
 
 // PendingStorageAt returns the value of key in the contract storage of the given account in the pending state.
 func (ec *Client) PendingStorageAt(ctx context.Context, account common.Address, key common.Hash) ([]byte, error) {
-	ec.Send(stateAccessCost)
-	return ec.c.PendingStorageAt(ctx, account, key)
+	ctx, done, err := ec.payFor(ctx, "eth_getStorageAt")
+	if err != nil {
+		return nil, err
+	}
+	value, err := ec.c.PendingStorageAt(ctx, account, key)
+	return value, done(err)
 }
 
 // PendingCodeAt returns the contract code of the given account in the pending state.
 func (ec *Client) PendingCodeAt(ctx context.Context, account common.Address) ([]byte, error) {
-	ec.Send(stateAccessCost)
-	return ec.c.PendingCodeAt(ctx, account)
+	ctx, done, err := ec.payFor(ctx, "eth_getCode")
+	if err != nil {
+		return nil, err
+	}
+	code, err := ec.c.PendingCodeAt(ctx, account)
+	return code, done(err)
 }
 
 // PendingNonceAt returns the account nonce of the given account in the pending state.
 // This is the nonce that should be used for the next transaction.
 func (ec *Client) PendingNonceAt(ctx context.Context, account common.Address) (uint64, error) {
-	ec.Send(stateAccessCost)
-	return ec.c.PendingNonceAt(ctx, account)
+	ctx, done, err := ec.payFor(ctx, "eth_getTransactionCount")
+	if err != nil {
+		return 0, err
+	}
+	nonce, err := ec.c.PendingNonceAt(ctx, account)
+	return nonce, done(err)
 }
 
 // PendingTransactionCount returns the total number of transactions in the pending state.
 func (ec *Client) PendingTransactionCount(ctx context.Context) (uint, error) {
-	ec.Send(stateAccessCost)
-	return ec.c.PendingTransactionCount(ctx)
+	ctx, done, err := ec.payFor(ctx, "eth_getBlockTransactionCountByNumber")
+	if err != nil {
+		return 0, err
+	}
+	count, err := ec.c.PendingTransactionCount(ctx)
+	return count, done(err)
 }
 
 // Contract Calling
@@ -238,22 +739,34 @@ func (ec *Client) PendingTransactionCount(ctx context.Context) (uint, error) {
 // CallContract executes a message call transaction, which is directly executed in the VM
 // of the node, but never mined into the blockchain.
 func (ec *Client) CallContract(ctx context.Context, msg ethereum.CallMsg, blockNumber *big.Int) ([]byte, error) {
-	ec.Send(contractCallingCost)
-	return ec.c.CallContract(ctx, msg, blockNumber)
+	ctx, done, err := ec.payFor(ctx, "eth_call")
+	if err != nil {
+		return nil, err
+	}
+	result, err := ec.c.CallContract(ctx, msg, blockNumber)
+	return result, done(err)
 }
 
 // PendingCallContract executes a message call transaction using the EVM.
 // The state seen by the contract call is the pending state.
 func (ec *Client) PendingCallContract(ctx context.Context, msg ethereum.CallMsg) ([]byte, error) {
-	ec.Send(contractCallingCost)
-	return ec.c.PendingCallContract(ctx, msg)
+	ctx, done, err := ec.payFor(ctx, "eth_call")
+	if err != nil {
+		return nil, err
+	}
+	result, err := ec.c.PendingCallContract(ctx, msg)
+	return result, done(err)
 }
 
 // SuggestGasPrice retrieves the currently suggested gas price to allow a timely
 // execution of a transaction.
 func (ec *Client) SuggestGasPrice(ctx context.Context) (*big.Int, error) {
-	ec.Send(estimateGasCost)
-	return ec.c.SuggestGasPrice(ctx)
+	ctx, done, err := ec.payFor(ctx, "eth_gasPrice")
+	if err != nil {
+		return nil, err
+	}
+	price, err := ec.c.SuggestGasPrice(ctx)
+	return price, done(err)
 }
 
 // EstimateGas tries to estimate the gas needed to execute a specific transaction based on
@@ -261,8 +774,12 @@ func (ec *Client) SuggestGasPrice(ctx context.Context) (*big.Int, error) {
 // the true gas limit requirement as other transactions may be added or removed by miners,
 // but it should provide a basis for setting a reasonable default.
 func (ec *Client) EstimateGas(ctx context.Context, msg ethereum.CallMsg) (uint64, error) {
-	ec.Send(estimateGasCost)
-	return ec.c.EstimateGas(ctx, msg)
+	ctx, done, err := ec.payFor(ctx, "eth_estimateGas")
+	if err != nil {
+		return 0, err
+	}
+	gas, err := ec.c.EstimateGas(ctx, msg)
+	return gas, done(err)
 }
 
 // SendTransaction injects a signed transaction into the pending pool for execution.
@@ -270,6 +787,9 @@ func (ec *Client) EstimateGas(ctx context.Context, msg ethereum.CallMsg) (uint64
 // If the transaction was a contract creation use the TransactionReceipt method to get the
 // contract address after the transaction has been mined.
 func (ec *Client) SendTransaction(ctx context.Context, tx *types.Transaction) error {
-	ec.Send(sendTransactionCost)
-	return ec.c.SendTransaction(ctx, tx)
+	ctx, done, err := ec.payFor(ctx, "eth_sendRawTransaction")
+	if err != nil {
+		return err
+	}
+	return done(ec.c.SendTransaction(ctx, tx))
 }
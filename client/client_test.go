@@ -0,0 +1,902 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MariusVanDerWijden/ShareMyRPC/pricing"
+	"github.com/MariusVanDerWijden/ShareMyRPC/raiden"
+	"github.com/MariusVanDerWijden/ShareMyRPC/raidentest"
+	"github.com/MariusVanDerWijden/ShareMyRPC/server"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind/backends"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/gorilla/websocket"
+)
+
+var (
+	token    = "0x95B2d84De40a0121061b105E6B54016a49621B44"
+	provider = "0x1F916ab5cf1B30B22f24Ebf435f53Ee665344Acf"
+	customer = "0x0000000000000000000000000000000000000001"
+)
+
+// ethAPI is the part of the eth namespace served by the fake node.
+type ethAPI struct{}
+
+func (ethAPI) BlockNumber() hexutil.Uint64 { return 16 }
+
+func (ethAPI) ChainId() *hexutil.Big { return (*hexutil.Big)(big.NewInt(1337)) }
+
+func (ethAPI) GetBlockByNumber(number rpc.BlockNumber, full bool) (map[string]interface{}, error) {
+	return nil, errors.New("header not found")
+}
+
+// headAPI serves the headers sent on heads to subscribers.
+type headAPI struct {
+	ethAPI
+	heads chan *types.Header
+}
+
+func (api *headAPI) NewHeads(ctx context.Context) (*rpc.Subscription, error) {
+	notifier, supported := rpc.NotifierFromContext(ctx)
+	if !supported {
+		return nil, rpc.ErrNotificationsUnsupported
+	}
+	sub := notifier.CreateSubscription()
+	go func() {
+		for {
+			select {
+			case header := <-api.heads:
+				notifier.Notify(sub.ID, header)
+			case <-sub.Err():
+				return
+			}
+		}
+	}()
+	return sub, nil
+}
+
+// customAPI is a namespace the client has no typed wrapper for.
+type customAPI struct{}
+
+func (customAPI) Echo(s string) string { return s }
+
+// simAPI is the part of the eth namespace used by contract bindings,
+// served from a simulated chain.
+type simAPI struct {
+	sim *backends.SimulatedBackend
+}
+
+type callArgs struct {
+	From     common.Address  `json:"from"`
+	To       *common.Address `json:"to"`
+	Gas      hexutil.Uint64  `json:"gas"`
+	GasPrice *hexutil.Big    `json:"gasPrice"`
+	Value    *hexutil.Big    `json:"value"`
+	Data     hexutil.Bytes   `json:"data"`
+}
+
+func (args callArgs) msg() ethereum.CallMsg {
+	return ethereum.CallMsg{
+		From:     args.From,
+		To:       args.To,
+		Gas:      uint64(args.Gas),
+		GasPrice: (*big.Int)(args.GasPrice),
+		Value:    (*big.Int)(args.Value),
+		Data:     args.Data,
+	}
+}
+
+func (api *simAPI) GetTransactionCount(ctx context.Context, account common.Address, number rpc.BlockNumber) (hexutil.Uint64, error) {
+	if number == rpc.PendingBlockNumber {
+		nonce, err := api.sim.PendingNonceAt(ctx, account)
+		return hexutil.Uint64(nonce), err
+	}
+	nonce, err := api.sim.NonceAt(ctx, account, nil)
+	return hexutil.Uint64(nonce), err
+}
+
+func (api *simAPI) GetCode(ctx context.Context, account common.Address, number rpc.BlockNumber) (hexutil.Bytes, error) {
+	if number == rpc.PendingBlockNumber {
+		return api.sim.PendingCodeAt(ctx, account)
+	}
+	return api.sim.CodeAt(ctx, account, nil)
+}
+
+func (api *simAPI) GasPrice(ctx context.Context) (*hexutil.Big, error) {
+	price, err := api.sim.SuggestGasPrice(ctx)
+	return (*hexutil.Big)(price), err
+}
+
+func (api *simAPI) EstimateGas(ctx context.Context, args callArgs) (hexutil.Uint64, error) {
+	gas, err := api.sim.EstimateGas(ctx, args.msg())
+	return hexutil.Uint64(gas), err
+}
+
+func (api *simAPI) Call(ctx context.Context, args callArgs, number rpc.BlockNumber) (hexutil.Bytes, error) {
+	if number == rpc.PendingBlockNumber {
+		return api.sim.PendingCallContract(ctx, args.msg())
+	}
+	return api.sim.CallContract(ctx, args.msg(), nil)
+}
+
+// SendRawTransaction mines the transaction right away.
+func (api *simAPI) SendRawTransaction(ctx context.Context, data hexutil.Bytes) (common.Hash, error) {
+	tx := new(types.Transaction)
+	if err := rlp.DecodeBytes(data, tx); err != nil {
+		return common.Hash{}, err
+	}
+	if err := api.sim.SendTransaction(ctx, tx); err != nil {
+		return common.Hash{}, err
+	}
+	api.sim.Commit()
+	return tx.Hash(), nil
+}
+
+func (api *simAPI) GetTransactionReceipt(ctx context.Context, hash common.Hash) (*types.Receipt, error) {
+	return api.sim.TransactionReceipt(ctx, hash)
+}
+
+// testProvider is a provider serving a fake node through a fake raiden network.
+type testProvider struct {
+	url  string           // url of the proxy of the provider
+	us   *raidentest.Node // raiden node of the customer
+	them *raidentest.Node // raiden node of the provider
+
+	proxy *httptest.Server
+}
+
+// newTestProvider starts a provider in front of a node serving eth as the
+// eth namespace.
+func newTestProvider(t *testing.T, eth interface{}, opts ...server.Option) *testProvider {
+	network := raidentest.NewNetwork()
+	t.Cleanup(network.Close)
+	return addTestProvider(t, network, network.NewNode(customer), provider, eth, opts...)
+}
+
+// addTestProvider starts a provider with the raiden address in the network
+// of the customer node us.
+func addTestProvider(t *testing.T, network *raidentest.Network, us *raidentest.Node, address string, eth interface{}, opts ...server.Option) *testProvider {
+	them := network.NewNode(address)
+	network.OpenChannel(token, us, them, pricing.Ether(1000).Int(), big.NewInt(0))
+
+	node := rpc.NewServer()
+	if err := node.RegisterName("eth", eth); err != nil {
+		t.Fatal(err)
+	}
+	if err := node.RegisterName("custom", new(customAPI)); err != nil {
+		t.Fatal(err)
+	}
+	nodeServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if websocket.IsWebSocketUpgrade(r) {
+			node.WebsocketHandler([]string{"*"}).ServeHTTP(w, r)
+			return
+		}
+		node.ServeHTTP(w, r)
+	}))
+	t.Cleanup(nodeServer.Close)
+
+	srv, err := server.NewServer(them.URL(), token, customer, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Close)
+	proxy := httptest.NewServer(server.NewProxy(srv, nodeServer.URL, server.WithNodeWebSocket(wsURL(nodeServer.URL))))
+	t.Cleanup(proxy.Close)
+	return &testProvider{url: proxy.URL, us: us, them: them, proxy: proxy}
+}
+
+// wsURL returns the websocket url of the http server at url.
+func wsURL(url string) string {
+	return "ws" + strings.TrimPrefix(url, "http")
+}
+
+// newTestClient connects a client to a test provider.
+// It returns the raiden node of the provider.
+func newTestClient(t *testing.T, opts ...Option) (*Client, *raidentest.Node) {
+	p := newTestProvider(t, new(ethAPI))
+	client, err := NewClientFromURL(p.url, p.us.URL(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Close)
+	return client, p.them
+}
+
+func TestBlockNumber(t *testing.T) {
+	client, them := newTestClient(t)
+	no, err := client.BlockNumber(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if no != 16 {
+		t.Fatalf("wrong block number: %v", no)
+	}
+	if balance := them.Balance(token, customer); balance.Cmp(pricing.DefaultSchedule().Price("eth_blockNumber").Int()) != 0 {
+		t.Fatalf("wrong provider balance: %v", balance)
+	}
+}
+
+func TestConcurrentCalls(t *testing.T) {
+	client, them := newTestClient(t)
+	token, other := client.peer()
+	var (
+		wg    sync.WaitGroup
+		calls = 20
+		errc  = make(chan error, calls)
+	)
+	for i := 0; i < calls; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client.Init(token, other)
+			client.SetSchedule(pricing.DefaultSchedule())
+			if _, err := client.BlockNumber(context.Background()); err != nil {
+				errc <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errc)
+	for err := range errc {
+		t.Fatal(err)
+	}
+	want := new(big.Int).Mul(pricing.DefaultSchedule().Price("eth_blockNumber").Int(), big.NewInt(int64(calls)))
+	if balance := them.Balance(token, customer); balance.Cmp(want) != 0 {
+		t.Fatalf("wrong provider balance: have %v, want %v", balance, want)
+	}
+	if spent := client.Spent(); spent.Int().Cmp(want) != 0 {
+		t.Fatalf("wrong spending: have %v, want %v", spent, want)
+	}
+	// Calls paid by the same transfer keep entries of their own
+	entries, err := client.Ledger().Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != calls {
+		t.Fatalf("wrong number of entries: %d", len(entries))
+	}
+	for _, entry := range entries {
+		if entry.Method != "eth_blockNumber" || entry.Amount.Cmp(pricing.DefaultSchedule().Price("eth_blockNumber")) != 0 {
+			t.Fatalf("wrong entry: %+v", entry)
+		}
+	}
+}
+
+func TestNewClientNotReady(t *testing.T) {
+	network := raidentest.NewNetwork()
+	defer network.Close()
+	node := network.NewNode(customer)
+
+	if _, err := NewClientFromURL("http://127.0.0.1:1", node.URL(), WithAddress(provider)); !errors.Is(err, raiden.ErrWrongAddress) {
+		t.Fatalf("expected wrong address, got %v", err)
+	}
+	node.SetStatus("syncing", 100)
+	if _, err := NewClientFromURL("http://127.0.0.1:1", node.URL()); !errors.Is(err, raiden.ErrNotReady) {
+		t.Fatalf("expected not ready, got %v", err)
+	}
+}
+
+func TestPaymentFailed(t *testing.T) {
+	client, _ := newTestClient(t)
+	client.Init(token, "0x000000000000000000000000000000000000dEaD")
+	_, err := client.BlockNumber(context.Background())
+	if !errors.Is(err, ErrPaymentFailed) {
+		t.Fatalf("expected failed payment, got %v", err)
+	}
+	if !raiden.IsInsufficientFunds(err) {
+		t.Fatalf("expected raiden error, got %v", err)
+	}
+}
+
+func TestPriceDiscovery(t *testing.T) {
+	max := pricing.DefaultSchedule()
+	client, _ := newTestClient(t, WithMaxPrices(max))
+	offer := client.Offer()
+	if offer == nil || offer.Token != token || offer.Address != provider {
+		t.Fatalf("wrong offer: %+v", offer)
+	}
+	if _, ok := offer.Schedule.Exceeds(max); ok {
+		t.Fatal("offer exceeds maximum")
+	}
+
+	max.Methods["eth_call"] = raiden.NewAmount(big.NewInt(1))
+	p := newTestProvider(t, new(ethAPI))
+	if _, err := NewClientFromURL(p.url, p.us.URL(), WithMaxPrices(max)); !errors.Is(err, ErrPricesTooHigh) {
+		t.Fatalf("expected prices too high, got %v", err)
+	}
+	// Offers with methods without price are not accepted
+	invalid := pricing.DefaultSchedule()
+	invalid.Methods["eth_call"] = nil
+	p = newTestProvider(t, new(ethAPI), server.WithSchedule(invalid))
+	if _, err := NewClientFromURL(p.url, p.us.URL(), WithMaxPrices(max)); err == nil || errors.Is(err, ErrPricesTooHigh) {
+		t.Fatalf("expected invalid schedule, got %v", err)
+	}
+	client, err := NewClientFromURL(p.url, p.us.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if client.Offer() != nil {
+		t.Fatalf("invalid offer accepted: %+v", client.Offer())
+	}
+}
+
+func TestPrepaid(t *testing.T) {
+	p := newTestProvider(t, new(ethAPI), server.WithTrustedPayers())
+	for _, opt := range []Option{WithPrepaid(nil, pricing.Ether(5)), WithPrepaid(pricing.Ether(20), nil)} {
+		if _, err := NewClientFromURL(p.url, p.us.URL(), opt); err == nil {
+			t.Fatal("incomplete prepaid options accepted")
+		}
+	}
+
+	price := pricing.DefaultSchedule().Price("eth_blockNumber").Int()
+	client, err := NewClientFromURL(p.url, p.us.URL(), WithPrepaid(pricing.Ether(20), pricing.Ether(5)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	them := p.them
+	for i := 0; i < 3; i++ {
+		if _, err := client.BlockNumber(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A single top up paid for all calls
+	if balance := them.Balance(token, customer); balance.Cmp(pricing.Ether(20).Int()) != 0 {
+		t.Fatalf("wrong provider balance: %v", balance)
+	}
+	want := new(big.Int).Sub(pricing.Ether(20).Int(), new(big.Int).Mul(price, big.NewInt(3)))
+	if credit := client.Credit(); credit.Int().Cmp(want) != 0 {
+		t.Fatalf("wrong local credit: have %v, want %v", credit, want)
+	}
+	if credit, err := client.RemoteCredit(context.Background()); err != nil || credit.Int().Cmp(want) != 0 {
+		t.Fatalf("wrong remote credit: have %v, want %v: %v", credit, want, err)
+	}
+	// The credit is topped up before it drops below the threshold
+	if _, err := client.BlockNumber(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if balance := them.Balance(token, customer); balance.Cmp(pricing.Ether(40).Int()) != 0 {
+		t.Fatalf("credit not topped up: %v", balance)
+	}
+}
+
+func TestPostpaid(t *testing.T) {
+	price := pricing.DefaultSchedule().Price("eth_blockNumber").Int()
+	p := newTestProvider(t, new(ethAPI), server.WithTrustedPayers(), server.WithCreditLimit(pricing.Ether(20)))
+	if _, err := NewClientFromURL(p.url, p.us.URL(), WithPrepaid(pricing.Ether(20), pricing.Ether(5)), WithPostpaid(3, 0)); err == nil {
+		t.Fatal("prepaid and postpaid mode combined")
+	}
+	client, err := NewClientFromURL(p.url, p.us.URL(), WithPostpaid(3, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	for i := 0; i < 2; i++ {
+		if _, err := client.BlockNumber(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if balance := p.them.Balance(token, customer); balance.Sign() != 0 {
+		t.Fatalf("calls paid before settlement: %v", balance)
+	}
+	if debt := client.Debt(); debt.Int().Cmp(new(big.Int).Mul(price, big.NewInt(2))) != 0 {
+		t.Fatalf("wrong debt: %v", debt)
+	}
+	// The third call settles the debt by a single payment
+	if _, err := client.BlockNumber(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := new(big.Int).Mul(price, big.NewInt(3))
+	for start := time.Now(); p.them.Balance(token, customer).Cmp(want) != 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("debt not settled: have %v, want %v", p.them.Balance(token, customer), want)
+		}
+	}
+	if debt := client.Debt(); debt.Int().Sign() != 0 {
+		t.Fatalf("debt left after settlement: %v", debt)
+	}
+	entries, _ := client.Ledger().Entries()
+	if len(entries) != 4 || !entries[0].Postpaid || entries[3].Postpaid || entries[3].Method != "" {
+		t.Fatalf("wrong ledger entries: %+v", entries)
+	}
+	// Calls over the credit limit of the provider fail until the debt is settled
+	manual, err := NewClientFromURL(p.url, p.us.URL(), WithPostpaid(0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manual.Close()
+	for i := 0; i < 5; i++ {
+		if _, err := manual.BlockNumber(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if _, err := manual.BlockNumber(ctx); err == nil {
+		t.Fatal("call over the credit limit served")
+	}
+	// Calls that were not served are not owed
+	owed := new(big.Int).Mul(price, big.NewInt(5))
+	if debt := manual.Debt(); debt.Int().Cmp(owed) != 0 {
+		t.Fatalf("unserved call owed: have %v, want %v", debt, owed)
+	}
+	if spent := manual.Spent(); spent.Int().Cmp(owed) != 0 {
+		t.Fatalf("unserved call spent: have %v, want %v", spent, owed)
+	}
+	entries, _ = manual.Ledger().Entries()
+	if last := entries[len(entries)-1]; !last.Postpaid || last.Success {
+		t.Fatalf("unserved call not recorded as failed: %+v", last)
+	}
+	if err := manual.Settle(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manual.BlockNumber(context.Background()); err != nil {
+		t.Fatalf("call not served after settlement: %v", err)
+	}
+	// Websocket clients are served on credit as well
+	ws, err := NewClientFromURL(wsURL(p.url), p.us.URL(), WithPostpaid(0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	ctx, cancel = context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, err := ws.BlockNumber(ctx); err != nil {
+		t.Fatalf("websocket call not served on credit: %v", err)
+	}
+}
+
+func TestRefund(t *testing.T) {
+	price := pricing.DefaultSchedule().Price("eth_getBlockByNumber")
+	p := newTestProvider(t, new(ethAPI), server.WithTrustedPayers())
+	client, err := NewClientFromURL(p.url, p.us.URL(), WithPayerAddress())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	them := p.them
+	if _, err := client.HeaderByNumber(context.Background(), nil); err == nil || !strings.Contains(err.Error(), "header not found") {
+		t.Fatalf("expected error of the node, got %v", err)
+	}
+	if refunds := client.Refunds(); refunds.Cmp(price) != 0 {
+		t.Fatalf("wrong refunds: have %v, want %v", refunds, price)
+	}
+	if spent := client.Spent(); spent.Int().Sign() != 0 {
+		t.Fatalf("refunded call counted as spent: %v", spent)
+	}
+	// The next call is paid from the refund
+	if _, err := client.BlockNumber(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if balance := them.Balance(token, customer); balance.Cmp(price.Int()) != 0 {
+		t.Fatalf("wrong provider balance: %v", balance)
+	}
+	if refunds := client.Refunds(); refunds.Int().Sign() != 0 {
+		t.Fatalf("refunds left: %v", refunds)
+	}
+	entries, _ := client.Ledger().Entries()
+	if len(entries) != 3 || !entries[1].Refund || entries[1].Amount.Cmp(price) != 0 || !entries[2].Refund || entries[2].Prepaid || entries[2].Method != "eth_blockNumber" {
+		t.Fatalf("wrong ledger entries: %+v", entries)
+	}
+
+	// Clients paying by identifier only record their refunds
+	byID, _ := newTestClient(t)
+	if _, err := byID.HeaderByNumber(context.Background(), nil); err == nil {
+		t.Fatal("expected error of the node")
+	}
+	if refunds := byID.Refunds(); refunds.Int().Sign() != 0 {
+		t.Fatalf("unspendable refunds counted: %v", refunds)
+	}
+	entries, _ = byID.Ledger().Entries()
+	if len(entries) != 2 || !entries[1].Refund || entries[1].Amount.Cmp(price) != 0 {
+		t.Fatalf("wrong ledger entries: %+v", entries)
+	}
+}
+
+func TestDepositPause(t *testing.T) {
+	p := newTestProvider(t, new(ethAPI))
+	client, err := NewClientFromURL(p.url, p.us.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// The raiden node of the manager holds back deposits and then fails them
+	release := make(chan struct{})
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPatch {
+			<-release
+			http.Error(w, `{"errors": "deposit failed"}`, http.StatusConflict)
+			return
+		}
+		p.us.ServeHTTP(w, r)
+	}))
+	defer node.Close()
+	m, err := raiden.NewChannelManager(raiden.NewRaiden(node.URL+raidentest.APIPath), pricing.Ether(1000), raiden.ChannelConfig{
+		Token:     token,
+		Partner:   provider,
+		Threshold: pricing.Ether(2000),
+		Target:    pricing.Ether(3000),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := client.SetChannelManager(m)
+	defer sub.Unsubscribe()
+	checked := make(chan error, 1)
+	go func() { checked <- m.Check(context.Background()) }()
+
+	// Calls wait while the deposit is pending
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		client.lock.Lock()
+		paused := client.paused != nil
+		client.lock.Unlock()
+		if paused {
+			break
+		}
+		if time.Now().After(deadline) {
+			close(release)
+			t.Fatal("client not paused")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	called := make(chan error, 1)
+	go func() {
+		_, err := client.BlockNumber(context.Background())
+		called <- err
+	}()
+	select {
+	case err := <-called:
+		close(release)
+		t.Fatalf("call not paused: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The failed deposit resumes the calls
+	close(release)
+	if err := <-checked; err == nil {
+		t.Fatal("expected failed deposit")
+	}
+	select {
+	case err := <-called:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("call not resumed")
+	}
+}
+
+func TestBudget(t *testing.T) {
+	price := pricing.DefaultSchedule().Price("eth_blockNumber")
+	client, them := newTestClient(t, WithBudget(Budget{
+		Methods: map[string]*raiden.Amount{"eth_blockNumber": price},
+	}))
+	if _, err := client.BlockNumber(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.BlockNumber(context.Background()); !errors.Is(err, ErrBudgetExceeded) {
+		t.Fatalf("expected exceeded budget, got %v", err)
+	}
+	if balance := them.Balance(token, customer); balance.Cmp(price.Int()) != 0 {
+		t.Fatalf("call over budget was paid: %v", balance)
+	}
+	// Budgets can be changed at runtime
+	client.SetBudget(Budget{PerMinute: pricing.Ether(12)})
+	if _, err := client.BlockNumber(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.BlockNumber(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.BlockNumber(context.Background()); !errors.Is(err, ErrBudgetExceeded) {
+		t.Fatalf("expected exceeded rate, got %v", err)
+	}
+	client.SetBudget(Budget{Session: client.Spent()})
+	if err := client.Send(raiden.NewAmount(big.NewInt(1))); !errors.Is(err, ErrBudgetExceeded) {
+		t.Fatalf("expected exceeded session cap, got %v", err)
+	}
+	// Failed payments do not count against the budget
+	spent := client.Spent()
+	client.SetBudget(Budget{})
+	client.Init(token, "0x000000000000000000000000000000000000dEaD")
+	if _, err := client.BlockNumber(context.Background()); !errors.Is(err, ErrPaymentFailed) {
+		t.Fatalf("expected failed payment, got %v", err)
+	}
+	if client.Spent().Cmp(spent) != 0 {
+		t.Fatalf("failed payment counted: %v", client.Spent())
+	}
+}
+
+func TestLedger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ledger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ledger, err := NewFileLedger(filepath.Join(dir, "ledger.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ledger.Close()
+
+	client, _ := newTestClient(t, WithLedger(ledger))
+	if _, err := client.BlockNumber(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	client.Init(token, "0x000000000000000000000000000000000000dEaD")
+	client.BlockNumber(context.Background())
+
+	entries, err := ledger.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("wrong number of entries: %d", len(entries))
+	}
+	paid, failed := entries[0], entries[1]
+	if paid.Method != "eth_blockNumber" || paid.Peer != provider || paid.Token != token || !paid.Success || paid.Identifier == 0 {
+		t.Fatalf("wrong entry: %+v", paid)
+	}
+	if paid.Amount.Cmp(pricing.DefaultSchedule().Price("eth_blockNumber")) != 0 {
+		t.Fatalf("wrong amount: %v", paid.Amount)
+	}
+	if failed.Success {
+		t.Fatalf("failed payment recorded as success: %+v", failed)
+	}
+
+	var buf bytes.Buffer
+	if err := client.Export(&buf, FormatCSV); err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || records[1][1] != "eth_blockNumber" || records[1][3] != paid.Identifier.String() {
+		t.Fatalf("wrong csv export: %v", records)
+	}
+	buf.Reset()
+	if err := client.Export(&buf, FormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	var exported []Entry
+	if err := json.Unmarshal(buf.Bytes(), &exported); err != nil || len(exported) != 2 || exported[0].Identifier != paid.Identifier {
+		t.Fatalf("wrong json export: %s %v", buf.Bytes(), err)
+	}
+}
+
+func TestCallContext(t *testing.T) {
+	client, them := newTestClient(t)
+	var echo string
+	if err := client.CallContext(context.Background(), &echo, "custom_echo", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if echo != "hello" {
+		t.Fatalf("wrong result: %q", echo)
+	}
+	var number hexutil.Uint64
+	batch := []rpc.BatchElem{
+		{Method: "eth_blockNumber", Result: &number},
+		{Method: "custom_echo", Args: []interface{}{"batch"}, Result: &echo},
+	}
+	if err := client.BatchCallContext(context.Background(), batch); err != nil {
+		t.Fatal(err)
+	}
+	for _, elem := range batch {
+		if elem.Error != nil {
+			t.Fatal(elem.Error)
+		}
+	}
+	if number != 16 || echo != "batch" {
+		t.Fatalf("wrong batch results: %v %q", number, echo)
+	}
+	// The batch was paid by a single payment
+	entries, _ := client.Ledger().Entries()
+	if len(entries) != 2 || entries[1].Method != "eth_blockNumber,custom_echo" {
+		t.Fatalf("wrong payments: %+v", entries)
+	}
+	schedule := pricing.DefaultSchedule()
+	want := schedule.Total("custom_echo", "eth_blockNumber", "custom_echo")
+	if balance := them.Balance(token, customer); balance.Cmp(want.Int()) != 0 {
+		t.Fatalf("wrong provider balance: have %v, want %v", balance, want)
+	}
+}
+
+func TestContract(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	auth := bind.NewKeyedTransactor(key)
+	sim := backends.NewSimulatedBackend(core.GenesisAlloc{auth.From: {Balance: big.NewInt(10000000000)}}, 10000000)
+	defer sim.Close()
+
+	p := newTestProvider(t, &simAPI{sim: sim})
+	client, err := NewClientFromURL(p.url, p.us.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	_, tx, interactor, err := DeployInteractor(auth, client, "Deploy string")
+	if err != nil {
+		t.Fatalf("could not deploy contract: %v", err)
+	}
+	if _, err := bind.WaitDeployed(ctx, client, tx); err != nil {
+		t.Fatalf("contract not deployed: %v", err)
+	}
+	if tx, err = interactor.Transact(auth, "Transact string"); err != nil {
+		t.Fatalf("could not transact: %v", err)
+	}
+	if _, err := bind.WaitMined(ctx, client, tx); err != nil {
+		t.Fatalf("transaction not mined: %v", err)
+	}
+	if str, err := interactor.DeployString(nil); err != nil || str != "Deploy string" {
+		t.Fatalf("wrong deploy string: %q %v", str, err)
+	}
+	if str, err := interactor.TransactString(nil); err != nil || str != "Transact string" {
+		t.Fatalf("wrong transact string: %q %v", str, err)
+	}
+	// Every call was paid for
+	if balance := p.them.Balance(token, customer); balance.Sign() == 0 || balance.Cmp(client.Spent().Int()) != 0 {
+		t.Fatalf("wrong provider balance: have %v, spent %v", balance, client.Spent())
+	}
+}
+
+func TestSubscription(t *testing.T) {
+	api := &headAPI{heads: make(chan *types.Header)}
+	p := newTestProvider(t, api, server.WithTrustedPayers())
+
+	// Subscriptions over http are refused without paying
+	polling, err := NewClientFromURL(p.url, p.us.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer polling.Close()
+	if _, err := polling.SubscribeNewHead(context.Background(), make(chan *types.Header)); !errors.Is(err, rpc.ErrNotificationsUnsupported) {
+		t.Fatalf("expected unsupported notifications, got %v", err)
+	}
+	if spent := polling.Spent(); spent.Int().Sign() != 0 {
+		t.Fatalf("subscription over http paid: %v", spent)
+	}
+
+	client, err := NewClientFromURL(wsURL(p.url), p.us.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	heads := make(chan *types.Header)
+	sub, err := client.SubscribeNewHead(context.Background(), heads)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Unsubscribe()
+	receive := func(number int64) {
+		api.heads <- &types.Header{Number: big.NewInt(number), Difficulty: big.NewInt(1)}
+		select {
+		case header := <-heads:
+			if header.Number.Int64() != number {
+				t.Fatalf("wrong header: %v", header.Number)
+			}
+		case err := <-sub.Err():
+			t.Fatalf("subscription failed: %v", err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("header not delivered")
+		}
+	}
+	for i := int64(0); i < 3; i++ {
+		receive(i)
+	}
+	// The subscription and every notification are paid for,
+	// the next notification in advance
+	schedule := pricing.DefaultSchedule()
+	notification := pricing.NotificationMethod("newHeads")
+	want := schedule.Total(pricing.SubscriptionMethod("newHeads"), notification, notification, notification, notification)
+	for start := time.Now(); client.Spent().Cmp(want) != 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("wrong amount spent: have %v, want %v", client.Spent(), want)
+		}
+	}
+	// The subscription ends when a payment fails
+	client.SetBudget(Budget{Session: client.Spent()})
+	receive(3)
+	select {
+	case err := <-sub.Err():
+		if !errors.Is(err, ErrBudgetExceeded) {
+			t.Fatalf("wrong error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscription not torn down")
+	}
+}
+
+func TestPool(t *testing.T) {
+	network := raidentest.NewNetwork()
+	defer network.Close()
+	us := network.NewNode(customer)
+	cheapSchedule := &pricing.Schedule{Version: "cheap", Default: pricing.Ether(1)}
+	cheap := addTestProvider(t, network, us, "0x0000000000000000000000000000000000000002", new(ethAPI), server.WithSchedule(cheapSchedule))
+	expensive := addTestProvider(t, network, us, provider, new(ethAPI))
+
+	pool, err := NewPool(us.URL(), []Provider{{URL: expensive.url}, {URL: cheap.url}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	blockNumber := func() {
+		var number hexutil.Uint64
+		if err := pool.CallContext(context.Background(), &number, "eth_blockNumber"); err != nil {
+			t.Fatal(err)
+		}
+		if number != 16 {
+			t.Fatalf("wrong block number: %v", number)
+		}
+	}
+	checkBalances := func(cheapBalance, expensiveBalance int64) {
+		t.Helper()
+		if balance := cheap.them.Balance(token, customer); balance.Cmp(pricing.Ether(cheapBalance).Int()) != 0 {
+			t.Fatalf("wrong balance of cheap provider: %v", balance)
+		}
+		if balance := expensive.them.Balance(token, customer); balance.Cmp(pricing.Ether(expensiveBalance).Int()) != 0 {
+			t.Fatalf("wrong balance of expensive provider: %v", balance)
+		}
+	}
+	// The cheap provider is preferred
+	blockNumber()
+	checkBalances(1, 0)
+
+	// The pool fails over after the cheap provider was paid and failed
+	cheap.proxy.Close()
+	blockNumber()
+	checkBalances(2, 4)
+	blockNumber()
+	checkBalances(2, 8)
+	if spent := pool.Spent(); spent.Cmp(pricing.Ether(10)) != 0 {
+		t.Fatalf("wrong amount spent: %v", spent)
+	}
+	if entries, _ := pool.Ledger().Entries(); len(entries) != 4 {
+		t.Fatalf("wrong number of payments: %d", len(entries))
+	}
+}
+
+func TestPoolLatency(t *testing.T) {
+	network := raidentest.NewNetwork()
+	defer network.Close()
+	us := network.NewNode(customer)
+	cheapSchedule := &pricing.Schedule{Version: "cheap", Default: pricing.Ether(1)}
+	cheap := addTestProvider(t, network, us, "0x0000000000000000000000000000000000000002", new(ethAPI), server.WithSchedule(cheapSchedule))
+	expensive := addTestProvider(t, network, us, provider, new(ethAPI))
+
+	pool, err := NewPool(us.URL(), []Provider{{URL: cheap.url}, {URL: expensive.url}}, WithLatencyBudget(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	pool.members[0].latency = time.Second
+	if candidates := pool.candidates("eth_blockNumber"); len(candidates) != 2 || candidates[0] != pool.members[1] {
+		t.Fatal("slow provider preferred")
+	}
+}
@@ -0,0 +1,68 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"sync"
+
+	"github.com/MariusVanDerWijden/ShareMyRPC/raiden"
+	"github.com/MariusVanDerWijden/ShareMyRPC/server"
+)
+
+// credit is the prepaid balance of the client at the peer.
+type credit struct {
+	topUp     *big.Int // amount paid whenever the balance runs low
+	threshold *big.Int // the balance is topped up if it would drop below
+
+	lock    sync.Mutex
+	balance *big.Int // balance at the peer as tracked by the client
+}
+
+// Credit returns the prepaid balance of the client at the peer as tracked
+// by the client, or nil if the client is not in prepaid mode.
+func (ec *Client) Credit() *raiden.Amount {
+	if ec.credit == nil {
+		return nil
+	}
+	ec.credit.lock.Lock()
+	defer ec.credit.lock.Unlock()
+	return raiden.NewAmount(ec.credit.balance)
+}
+
+// RemoteCredit asks the peer for the prepaid balance of the client.
+// Payments that are still on their way are not included.
+func (ec *Client) RemoteCredit(ctx context.Context) (*raiden.Amount, error) {
+	if ec.rpc == nil || ec.address == "" {
+		return nil, errors.New("client does not know its raiden address")
+	}
+	balance := new(raiden.Amount)
+	if err := ec.rpc.CallContext(ctx, balance, server.CreditMethod, ec.address); err != nil {
+		return nil, err
+	}
+	return balance, nil
+}
+
+// spendCredit debits amount from the prepaid balance. If the balance would
+// drop below the threshold, it is topped up by a single raiden payment first.
+func (ec *Client) spendCredit(ctx context.Context, method string, amount *raiden.Amount) error {
+	c := ec.credit
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	after := new(big.Int).Sub(c.balance, amount.Int())
+	if after.Cmp(c.threshold) < 0 {
+		// Pay at least enough to stay above the threshold
+		topUp := new(big.Int).Sub(c.threshold, after)
+		if topUp.Cmp(c.topUp) < 0 {
+			topUp.Set(c.topUp)
+		}
+		if _, err := ec.transfer(ctx, "", raiden.NewAmount(topUp)); err != nil {
+			return err
+		}
+		c.balance.Add(c.balance, topUp)
+	}
+	c.balance.Sub(c.balance, amount.Int())
+	ec.record(Entry{Method: method, Amount: amount, Prepaid: true, Success: true})
+	return nil
+}
@@ -0,0 +1,66 @@
+package client
+
+import (
+	"strings"
+
+	"github.com/MariusVanDerWijden/ShareMyRPC/raiden"
+	"github.com/ethereum/go-ethereum/event"
+)
+
+// SetChannelManager pauses the calls of the client while the manager
+// deposits into the channel with the peer. The returned subscription
+// can be used to detach the client from the manager again.
+func (ec *Client) SetChannelManager(m *raiden.ChannelManager) event.Subscription {
+	events := make(chan raiden.ChannelEvent, 16)
+	sub := m.Subscribe(events)
+	go ec.watchDeposits(events, sub)
+	return sub
+}
+
+func (ec *Client) watchDeposits(events chan raiden.ChannelEvent, sub event.Subscription) {
+	defer ec.resume()
+	for {
+		select {
+		case ev := <-events:
+			token, other := ec.peer()
+			if !strings.EqualFold(ev.Token, token) || !strings.EqualFold(ev.Partner, other) {
+				continue
+			}
+			switch ev.Type {
+			case raiden.DepositStarted:
+				ec.pause()
+			case raiden.DepositDone, raiden.DepositFailed:
+				ec.resume()
+			}
+		case <-sub.Err():
+			return
+		}
+	}
+}
+
+func (ec *Client) pause() {
+	ec.lock.Lock()
+	defer ec.lock.Unlock()
+	if ec.paused == nil {
+		ec.paused = make(chan struct{})
+	}
+}
+
+func (ec *Client) resume() {
+	ec.lock.Lock()
+	defer ec.lock.Unlock()
+	if ec.paused != nil {
+		close(ec.paused)
+		ec.paused = nil
+	}
+}
+
+// waitDeposit blocks until no deposit into the channel with the peer is pending.
+func (ec *Client) waitDeposit() {
+	ec.lock.Lock()
+	paused := ec.paused
+	ec.lock.Unlock()
+	if paused != nil {
+		<-paused
+	}
+}
@@ -0,0 +1,39 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/MariusVanDerWijden/ShareMyRPC/raiden"
+)
+
+// ErrPaymentFailed is matched by the errors of calls whose payment failed.
+// The call is not sent to the peer in that case.
+var ErrPaymentFailed = errors.New("payment failed")
+
+// ErrPricesTooHigh is returned if the prices of the peer exceed the maximum.
+var ErrPricesTooHigh = errors.New("prices too high")
+
+// ErrBudgetExceeded is returned instead of paying for a call that would
+// exceed the budget of the client.
+var ErrBudgetExceeded = errors.New("budget exceeded")
+
+// PaymentError is returned if the payment for a call failed.
+// It wraps the error of the raiden node and matches ErrPaymentFailed.
+type PaymentError struct {
+	Amount *raiden.Amount
+	Err    error
+}
+
+func (e *PaymentError) Error() string {
+	return fmt.Sprintf("payment of %v failed: %v", e.Amount, e.Err)
+}
+
+func (e *PaymentError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes PaymentError match ErrPaymentFailed.
+func (e *PaymentError) Is(target error) bool {
+	return target == ErrPaymentFailed
+}
@@ -0,0 +1,195 @@
+package client
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/MariusVanDerWijden/ShareMyRPC/raiden"
+)
+
+// Entry is a payment recorded in a ledger.
+//
+// Entries that are neither prepaid nor postpaid stand for raiden payments
+// and can be matched against the payment history of the raiden node by their
+// identifier. In prepaid mode the top ups and in postpaid mode the
+// settlements are raiden payments without a method, and every call is
+// recorded as a prepaid or postpaid entry without an identifier. Refunds of
+// the peer for failed calls are recorded as refund entries without a method,
+// and the calls paid from them as refund entries with the method.
+type Entry struct {
+	Time       time.Time        `json:"time"`
+	Method     string           `json:"method"` // empty for top ups, settlements, refunds and Send
+	Amount     *raiden.Amount   `json:"amount"`
+	Identifier raiden.PaymentID `json:"identifier"`
+	Peer       string           `json:"peer"`
+	Token      string           `json:"token"`
+	Prepaid    bool             `json:"prepaid"`  // debited from the credit at the peer
+	Postpaid   bool             `json:"postpaid"` // served on credit, paid by a later settlement
+	Refund     bool             `json:"refund"`   // credited by the peer for failed calls, or paid from such credit
+	Success    bool             `json:"success"`
+}
+
+// Ledger records the payments of a client.
+type Ledger interface {
+	Record(entry Entry) error
+	Entries() ([]Entry, error)
+}
+
+// ExportFormat is a format the entries of a ledger can be exported in.
+type ExportFormat string
+
+const (
+	FormatCSV  ExportFormat = "csv"
+	FormatJSON ExportFormat = "json"
+)
+
+// MemoryLedger is a ledger that keeps its entries in memory.
+type MemoryLedger struct {
+	lock    sync.Mutex
+	entries []Entry
+}
+
+// NewMemoryLedger creates an empty in-memory ledger.
+func NewMemoryLedger() *MemoryLedger {
+	return new(MemoryLedger)
+}
+
+// Record adds the entry to the ledger.
+func (l *MemoryLedger) Record(entry Entry) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.entries = append(l.entries, entry)
+	return nil
+}
+
+// Entries returns all entries of the ledger, oldest first.
+func (l *MemoryLedger) Entries() ([]Entry, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]Entry(nil), l.entries...), nil
+}
+
+// FileLedger is a ledger that appends its entries to a file,
+// one JSON object per line.
+type FileLedger struct {
+	path string
+
+	lock sync.Mutex
+	file *os.File
+}
+
+// NewFileLedger opens the ledger in the file at path.
+// The file is created if it does not exist yet.
+func NewFileLedger(path string) (*FileLedger, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileLedger{path: path, file: file}, nil
+}
+
+// Record appends the entry to the file.
+func (l *FileLedger) Record(entry Entry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	_, err = l.file.Write(append(data, '\n'))
+	return err
+}
+
+// Entries reads all entries from the file, oldest first.
+func (l *FileLedger) Entries() ([]Entry, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	file, err := os.Open(l.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []Entry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// Close closes the file.
+func (l *FileLedger) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.file.Close()
+}
+
+// Ledger returns the ledger the client records its payments in.
+func (ec *Client) Ledger() Ledger {
+	return ec.ledger
+}
+
+// Export writes all payments recorded by the client to w.
+func (ec *Client) Export(w io.Writer, format ExportFormat) error {
+	entries, err := ec.ledger.Entries()
+	if err != nil {
+		return err
+	}
+	return exportEntries(w, format, entries)
+}
+
+func exportEntries(w io.Writer, format ExportFormat, entries []Entry) error {
+	switch format {
+	case FormatJSON:
+		if entries == nil {
+			entries = []Entry{}
+		}
+		return json.NewEncoder(w).Encode(entries)
+	case FormatCSV:
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"time", "method", "amount", "identifier", "peer", "token", "prepaid", "postpaid", "refund", "success"})
+		for _, entry := range entries {
+			cw.Write([]string{
+				entry.Time.UTC().Format(time.RFC3339Nano),
+				entry.Method,
+				entry.Amount.String(),
+				entry.Identifier.String(),
+				entry.Peer,
+				entry.Token,
+				strconv.FormatBool(entry.Prepaid),
+				strconv.FormatBool(entry.Postpaid),
+				strconv.FormatBool(entry.Refund),
+				strconv.FormatBool(entry.Success),
+			})
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+	return fmt.Errorf("unknown export format %q", format)
+}
+
+// record adds a payment to the ledger of the client.
+func (ec *Client) record(entry Entry) {
+	entry.Time = time.Now()
+	if entry.Peer == "" && entry.Token == "" {
+		entry.Token, entry.Peer = ec.peer()
+	}
+	if err := ec.ledger.Record(entry); err != nil {
+		fmt.Printf("could not record payment %v: %v\n", entry.Identifier, err)
+	}
+}
@@ -0,0 +1,128 @@
+package client
+
+import (
+	"errors"
+	"time"
+
+	"github.com/MariusVanDerWijden/ShareMyRPC/pricing"
+	"github.com/MariusVanDerWijden/ShareMyRPC/raiden"
+)
+
+// Option configures a client created by NewClientFromURL.
+type Option func(*config)
+
+type config struct {
+	address      string // expected address of the raiden node, empty for any
+	raidenOpts   []raiden.Option
+	schedule     *pricing.Schedule
+	maxPrices    *pricing.Schedule
+	payByAddress bool           // the raiden address is passed to the peer
+	topUp        *raiden.Amount // prepaid mode is enabled if set
+	threshold    *raiden.Amount
+	postpaid     bool
+	settleCalls  int
+	settlePeriod time.Duration
+	budget       *Budget
+	ledger       Ledger
+}
+
+func newConfig(opts []Option) *config {
+	cfg := new(config)
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	return cfg
+}
+
+// validate returns an error if the options contradict each other.
+func (cfg *config) validate() error {
+	prepaid := cfg.topUp != nil || cfg.threshold != nil
+	if prepaid && (cfg.topUp == nil || cfg.threshold == nil) {
+		return errors.New("prepaid mode needs a top up and a threshold")
+	}
+	if prepaid && cfg.postpaid {
+		return errors.New("prepaid and postpaid mode can not be combined")
+	}
+	return nil
+}
+
+// WithAddress makes the client fail if the raiden node
+// runs with another account than address.
+func WithAddress(address string) Option {
+	return func(cfg *config) {
+		cfg.address = address
+	}
+}
+
+// WithRaidenOptions configures the connector to the raiden node.
+func WithRaidenOptions(opts ...raiden.Option) Option {
+	return func(cfg *config) {
+		cfg.raidenOpts = append(cfg.raidenOpts, opts...)
+	}
+}
+
+// WithSchedule sets the price schedule the client pays by
+// if the peer does not publish its prices.
+func WithSchedule(schedule *pricing.Schedule) Option {
+	return func(cfg *config) {
+		cfg.schedule = schedule
+	}
+}
+
+// WithMaxPrices makes the client refuse to connect to a peer that does not
+// publish its prices, charges more than max or charges open subscriptions
+// more often than the period of max.
+func WithMaxPrices(max *pricing.Schedule) Option {
+	return func(cfg *config) {
+		cfg.maxPrices = max
+	}
+}
+
+// WithPayerAddress makes the client pass its raiden address to the peer,
+// which then pays the calls from the payments and refunds of that address
+// instead of tying every call to its payment by identifier. The address is
+// not authenticated, so peers only accept it if they trust their clients.
+// Prepaid and postpaid mode and websocket connections always pass the
+// address.
+func WithPayerAddress() Option {
+	return func(cfg *config) {
+		cfg.payByAddress = true
+	}
+}
+
+// WithPrepaid makes the client pay for its calls from a credit at the peer
+// instead of by a raiden payment per call. The peer has to trust the address
+// of the client, see WithPayerAddress. Whenever the credit would drop
+// below threshold, the client tops it up by paying topUp to the peer.
+func WithPrepaid(topUp, threshold *raiden.Amount) Option {
+	return func(cfg *config) {
+		cfg.topUp, cfg.threshold = topUp, threshold
+	}
+}
+
+// WithPostpaid makes the client pay for its calls after they were served,
+// which the peer has to allow by a credit limit for the address of the
+// client, see WithPayerAddress. The client settles the cost
+// of its calls by a single raiden payment every calls calls and every period,
+// a zero value disables either. Postpaid and prepaid mode can not be combined.
+func WithPostpaid(calls int, period time.Duration) Option {
+	return func(cfg *config) {
+		cfg.postpaid = true
+		cfg.settleCalls, cfg.settlePeriod = calls, period
+	}
+}
+
+// WithBudget limits the tokens the client spends on calls.
+func WithBudget(budget Budget) Option {
+	return func(cfg *config) {
+		cfg.budget = &budget
+	}
+}
+
+// WithLedger makes the client record its payments in ledger instead of
+// in memory.
+func WithLedger(ledger Ledger) Option {
+	return func(cfg *config) {
+		cfg.ledger = ledger
+	}
+}
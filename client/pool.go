@@ -0,0 +1,240 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/MariusVanDerWijden/ShareMyRPC/pricing"
+	"github.com/MariusVanDerWijden/ShareMyRPC/raiden"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// failedPause is how long a provider that failed after being paid is skipped.
+var failedPause = 30 * time.Second
+
+// ErrNoProvider is returned if no provider of a pool could serve a call.
+var ErrNoProvider = errors.New("no provider available")
+
+// Provider describes a peer serving calls to a pool.
+type Provider struct {
+	URL      string            // url of the node of the provider
+	Token    string            // token the provider is paid in, empty to use the published one
+	Address  string            // raiden address of the provider, empty to use the published one
+	Schedule *pricing.Schedule // prices if the provider does not publish any
+}
+
+// Pool sends every call to the cheapest healthy provider. Providers that
+// take longer than the latency budget are only used if no other provider
+// is available. All providers are paid from the same raiden node and share
+// the budget and ledger of the pool.
+type Pool struct {
+	members  []*member
+	budget   time.Duration
+	spending *spending
+	ledger   Ledger
+
+	lock sync.Mutex
+}
+
+// member is a provider in a pool.
+type member struct {
+	client  *Client
+	latency time.Duration // moving average of the successful calls
+	failed  time.Time     // when the provider last failed after being paid
+}
+
+// PoolOption configures a pool created by NewPool.
+type PoolOption func(*poolConfig)
+
+type poolConfig struct {
+	latencyBudget time.Duration
+	clientOpts    []Option
+}
+
+// WithLatencyBudget makes the pool prefer providers whose calls take
+// less than budget on average.
+func WithLatencyBudget(budget time.Duration) PoolOption {
+	return func(cfg *poolConfig) {
+		cfg.latencyBudget = budget
+	}
+}
+
+// WithClientOptions configures the clients of the providers.
+func WithClientOptions(opts ...Option) PoolOption {
+	return func(cfg *poolConfig) {
+		cfg.clientOpts = append(cfg.clientOpts, opts...)
+	}
+}
+
+// NewPool connects to the providers and the raiden node at raidenURL.
+func NewPool(raidenURL string, providers []Provider, opts ...PoolOption) (*Pool, error) {
+	if len(providers) == 0 {
+		return nil, ErrNoProvider
+	}
+	cfg := new(poolConfig)
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	clientCfg := newConfig(cfg.clientOpts)
+	p := &Pool{
+		budget:   cfg.latencyBudget,
+		spending: newSpending(),
+		ledger:   clientCfg.ledger,
+	}
+	if p.ledger == nil {
+		p.ledger = NewMemoryLedger()
+	}
+	if clientCfg.budget != nil {
+		p.spending.budget = clientCfg.budget.copy()
+	}
+	for _, provider := range providers {
+		clientOpts := cfg.clientOpts
+		if provider.Schedule != nil {
+			clientOpts = append(clientOpts[:len(clientOpts):len(clientOpts)], WithSchedule(provider.Schedule))
+		}
+		client, err := NewClientFromURL(provider.URL, raidenURL, clientOpts...)
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		if provider.Token != "" || provider.Address != "" {
+			token, address := client.peer()
+			if provider.Token != "" {
+				token = provider.Token
+			}
+			if provider.Address != "" {
+				address = provider.Address
+			}
+			client.Init(token, address)
+		}
+		client.spending = p.spending
+		client.ledger = p.ledger
+		p.members = append(p.members, &member{client: client})
+	}
+	return p, nil
+}
+
+// Close closes the connections to all providers.
+func (p *Pool) Close() {
+	for _, m := range p.members {
+		m.client.Close()
+	}
+}
+
+// SetBudget replaces the budget shared by all providers.
+func (p *Pool) SetBudget(budget Budget) {
+	p.spending.lock.Lock()
+	defer p.spending.lock.Unlock()
+	p.spending.budget = budget.copy()
+}
+
+// Spent returns the tokens spent on all providers.
+func (p *Pool) Spent() *raiden.Amount {
+	p.spending.lock.Lock()
+	defer p.spending.lock.Unlock()
+	return raiden.NewAmount(p.spending.total)
+}
+
+// Ledger returns the ledger the payments to all providers are recorded in.
+func (p *Pool) Ledger() Ledger {
+	return p.ledger
+}
+
+// Do calls fn with the client of the cheapest healthy provider for the
+// JSON-RPC methods fn calls. If the provider fails after it was paid, it is
+// marked as failed and fn is called again with the next provider. If the
+// payment to a provider fails, the next provider is tried as well.
+func (p *Pool) Do(ctx context.Context, fn func(*Client) error, methods ...string) error {
+	err := ErrNoProvider
+	for _, m := range p.candidates(methods...) {
+		start := time.Now()
+		if err = fn(m.client); err == nil {
+			p.succeeded(m, time.Since(start))
+			return nil
+		}
+		switch {
+		case ctx.Err() != nil || errors.Is(err, ErrBudgetExceeded) || answered(err):
+			return err
+		case errors.Is(err, ErrPaymentFailed):
+			continue
+		}
+		p.markFailed(m)
+	}
+	return err
+}
+
+// CallContext performs a JSON-RPC call on the cheapest healthy provider.
+func (p *Pool) CallContext(ctx context.Context, result interface{}, method string, args ...interface{}) error {
+	return p.Do(ctx, func(c *Client) error {
+		return c.CallContext(ctx, result, method, args...)
+	}, method)
+}
+
+// BatchCallContext sends all elements in a single request to the cheapest
+// healthy provider.
+func (p *Pool) BatchCallContext(ctx context.Context, b []rpc.BatchElem) error {
+	methods := make([]string, len(b))
+	for i, elem := range b {
+		methods[i] = elem.Method
+	}
+	return p.Do(ctx, func(c *Client) error {
+		return c.BatchCallContext(ctx, b)
+	}, methods...)
+}
+
+// answered returns true if err is an answer of the node
+// rather than a failure of the provider.
+func answered(err error) bool {
+	var rpcErr rpc.Error
+	return errors.As(err, &rpcErr) || errors.Is(err, ethereum.NotFound)
+}
+
+// candidates returns the healthy providers ordered by the price of the
+// methods, the ones within the latency budget first.
+func (p *Pool) candidates(methods ...string) []*member {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var fast, slow []*member
+	for _, m := range p.members {
+		if !m.failed.IsZero() && time.Since(m.failed) < failedPause {
+			continue
+		}
+		if p.budget > 0 && m.latency > p.budget {
+			slow = append(slow, m)
+		} else {
+			fast = append(fast, m)
+		}
+	}
+	byPrice := func(members []*member) {
+		sort.SliceStable(members, func(i, j int) bool {
+			return members[i].client.prices().Total(methods...).Cmp(members[j].client.prices().Total(methods...)) < 0
+		})
+	}
+	byPrice(fast)
+	byPrice(slow)
+	return append(fast, slow...)
+}
+
+// succeeded records the latency of a successful call.
+func (p *Pool) succeeded(m *member, latency time.Duration) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if m.latency == 0 {
+		m.latency = latency
+	} else {
+		m.latency = (3*m.latency + latency) / 4
+	}
+	m.failed = time.Time{}
+}
+
+// markFailed skips the provider for a while.
+func (p *Pool) markFailed(m *member) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	m.failed = time.Now()
+}
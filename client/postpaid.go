@@ -0,0 +1,136 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/MariusVanDerWijden/ShareMyRPC/raiden"
+	"github.com/MariusVanDerWijden/ShareMyRPC/server"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// debt is the cost of the calls the peer served to the client on credit.
+type debt struct {
+	calls int // the debt is settled after this many calls, 0 for no limit
+
+	lock   sync.Mutex
+	count  int      // calls since the last settlement
+	amount *big.Int // cost of the calls that were not paid for yet
+}
+
+// Debt returns the cost of the calls the client did not pay for yet,
+// or nil if the client is not in postpaid mode.
+func (ec *Client) Debt() *raiden.Amount {
+	if ec.debt == nil {
+		return nil
+	}
+	ec.debt.lock.Lock()
+	defer ec.debt.lock.Unlock()
+	return raiden.NewAmount(ec.debt.amount)
+}
+
+// Settle pays the debt of the client by a single raiden payment. Clients in
+// postpaid mode should settle before they are closed, the peer stops serving
+// them once the debt exceeds its credit limit.
+func (ec *Client) Settle(ctx context.Context) error {
+	d := ec.debt
+	if d == nil {
+		return nil
+	}
+	d.lock.Lock()
+	amount := d.amount
+	d.amount, d.count = new(big.Int), 0
+	d.lock.Unlock()
+
+	if amount.Sign() == 0 {
+		return nil
+	}
+	if _, err := ec.transfer(ctx, "", raiden.NewAmount(amount)); err != nil {
+		// Pay it with the next settlement
+		d.lock.Lock()
+		d.amount.Add(d.amount, amount)
+		d.lock.Unlock()
+		return err
+	}
+	return nil
+}
+
+// postpaidCall is the cost of a call on credit.
+type postpaidCall struct {
+	label    string
+	amount   *raiden.Amount
+	reserved *spend // reservation of the cost in the budget
+}
+
+// finish adds the cost of a call on credit to the debt if the peer served
+// the call. Otherwise the reservation in the budget is released and the
+// call is recorded as failed.
+func (ec *Client) finish(call *paidCall, err error) {
+	p := call.postpaid
+	if p == nil {
+		return
+	}
+	if ec.served(call, err) {
+		ec.pay(context.Background(), p.label, p.amount)
+		return
+	}
+	ec.spending.release(p.reserved)
+	ec.record(Entry{Method: p.label, Amount: p.amount, Postpaid: true, Success: false})
+}
+
+// served returns true if the peer served a call that ended with err. Over
+// http the peer served the call if it answered with status 200, otherwise
+// if it answered with anything but a missing payment.
+func (ec *Client) served(call *paidCall, err error) bool {
+	if ec.polling {
+		return call.status == http.StatusOK
+	}
+	var rpcErr rpc.Error
+	if errors.As(err, &rpcErr) {
+		return rpcErr.ErrorCode() != server.PaymentMissingCode
+	}
+	return err == nil || errors.Is(err, ethereum.NotFound)
+}
+
+// accrue adds the cost of a call to the debt. Every calls calls the debt is
+// settled in the background.
+func (ec *Client) accrue(method string, amount *raiden.Amount) {
+	d := ec.debt
+	d.lock.Lock()
+	d.amount.Add(d.amount, amount.Int())
+	d.count++
+	settle := d.calls > 0 && d.count >= d.calls
+	d.lock.Unlock()
+
+	ec.record(Entry{Method: method, Amount: amount, Postpaid: true, Success: true})
+	if settle {
+		go ec.settle()
+	}
+}
+
+// settleLoop settles the debt every period until the client is closed.
+func (ec *Client) settleLoop(period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ec.settle()
+		case <-ec.quit:
+			return
+		}
+	}
+}
+
+// settle settles the debt in the background.
+func (ec *Client) settle() {
+	if err := ec.Settle(context.Background()); err != nil {
+		fmt.Printf("could not settle debt: %v\n", err)
+	}
+}
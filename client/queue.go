@@ -0,0 +1,127 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"math/big"
+
+	"github.com/MariusVanDerWijden/ShareMyRPC/raiden"
+)
+
+// maxPaymentBatch is the maximum number of payments made by a single transfer.
+const maxPaymentBatch = 64
+
+var errClosed = errors.New("client closed")
+
+// payment is waiting in the payment queue of the client.
+type payment struct {
+	ctx    context.Context
+	method string
+	amount *raiden.Amount
+	id     raiden.PaymentID // set before the result is sent
+	result chan error
+}
+
+// transfer makes a raiden payment for method to the peer, records it in
+// the ledger and returns its identifier. Payments are queued and made one
+// transfer at a time, so concurrent callers do not race on the raiden node.
+// Payments made by the same transfer share the identifier.
+func (ec *Client) transfer(ctx context.Context, method string, amount *raiden.Amount) (raiden.PaymentID, error) {
+	p := &payment{ctx: ctx, method: method, amount: amount, result: make(chan error, 1)}
+	select {
+	case ec.payments <- p:
+	case <-ec.quit:
+		return 0, &PaymentError{Amount: amount, Err: errClosed}
+	case <-ctx.Done():
+		return 0, &PaymentError{Amount: amount, Err: ctx.Err()}
+	}
+	if err := <-p.result; err != nil {
+		return 0, err
+	}
+	return p.id, nil
+}
+
+// payLoop makes the queued payments in order. All payments that queued up
+// while a transfer was in flight are made by a single transfer.
+func (ec *Client) payLoop() {
+	for {
+		select {
+		case p := <-ec.payments:
+			batch := []*payment{p}
+		drain:
+			for len(batch) < maxPaymentBatch {
+				select {
+				case p := <-ec.payments:
+					batch = append(batch, p)
+				default:
+					break drain
+				}
+			}
+			ec.transferBatch(batch)
+		case <-ec.quit:
+			return
+		}
+	}
+}
+
+// transferBatch pays the sum of the batch in a single transfer and records
+// an entry for every payment of the batch.
+func (ec *Client) transferBatch(batch []*payment) {
+	// Payments whose callers gave up are not made
+	var (
+		live  []*payment
+		total = new(big.Int)
+	)
+	for _, p := range batch {
+		if err := p.ctx.Err(); err != nil {
+			p.result <- &PaymentError{Amount: p.amount, Err: err}
+			continue
+		}
+		live = append(live, p)
+		total.Add(total, p.amount.Int())
+	}
+	if len(live) == 0 {
+		return
+	}
+	// The transfer is only cancelled once all callers gave up
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		for _, p := range live {
+			select {
+			case <-p.ctx.Done():
+			case <-ctx.Done():
+				return
+			}
+		}
+		cancel()
+	}()
+
+	ec.waitDeposit()
+	token, other := ec.peer()
+	amount := raiden.NewAmount(total)
+	id, err := newPaymentID()
+	if err == nil {
+		opts := &raiden.PaymentOptions{Identifier: id}
+		_, err = ec.r.PayTokenContext(ctx, token, other, amount, opts)
+		// Every call keeps its own entry, linked by the shared identifier
+		for _, p := range live {
+			ec.record(Entry{
+				Method:     p.method,
+				Amount:     p.amount,
+				Identifier: id,
+				Peer:       other,
+				Token:      token,
+				Success:    err == nil,
+			})
+		}
+	}
+	for _, p := range live {
+		if err != nil {
+			p.result <- &PaymentError{Amount: p.amount, Err: err}
+		} else {
+			p.id = id
+			p.result <- nil
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package client
+
+import (
+	"fmt"
+	"math/big"
+	"net/http"
+
+	"github.com/MariusVanDerWijden/ShareMyRPC/raiden"
+	"github.com/MariusVanDerWijden/ShareMyRPC/server"
+)
+
+// paymentKey is the context key of the paidCall of a call.
+type paymentKey struct{}
+
+// transport passes the identifier of the payment for a call to the peer,
+// notes the status of the answer and takes note of the refunds the peer
+// announces in its responses for calls it failed to serve.
+type transport struct {
+	client *Client
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	call, _ := req.Context().Value(paymentKey{}).(*paidCall)
+	if call != nil && call.id != 0 {
+		req = req.Clone(req.Context())
+		req.Header.Set(server.PaymentIDHeader, call.id.String())
+	}
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if call != nil {
+		call.status = resp.StatusCode
+	}
+	if header := resp.Header.Get(server.RefundHeader); header != "" && t.client != nil {
+		amount, err := raiden.ParseAmount(header)
+		if err != nil {
+			fmt.Printf("invalid refund %q: %v\n", header, err)
+		} else {
+			t.client.refunded(amount)
+		}
+	}
+	return resp, nil
+}
+
+// Refunds returns the refunds of failed calls the client did not spend yet.
+// The next calls are paid from them before anything else. Refunds can only
+// be spent if the peer pays the calls of the client from the payments of its
+// address, see WithPayerAddress. Otherwise they are only recorded in the
+// ledger and stay with the peer as credit of the address.
+func (ec *Client) Refunds() *raiden.Amount {
+	ec.lock.Lock()
+	defer ec.lock.Unlock()
+	return raiden.NewAmount(ec.refunds)
+}
+
+// refunded records a refund of the peer for failed calls.
+func (ec *Client) refunded(amount *raiden.Amount) {
+	if amount.Int().Sign() == 0 {
+		return
+	}
+	if ec.byPayer {
+		ec.lock.Lock()
+		ec.refunds.Add(ec.refunds, amount.Int())
+		ec.lock.Unlock()
+		ec.spending.refund(amount.Int())
+	}
+	ec.record(Entry{Amount: amount, Refund: true, Success: true})
+}
+
+// spendRefunds pays as much of amount as possible from the refunds and
+// returns the rest.
+func (ec *Client) spendRefunds(method string, amount *raiden.Amount) *raiden.Amount {
+	ec.lock.Lock()
+	spent := new(big.Int).Set(amount.Int())
+	if spent.Cmp(ec.refunds) > 0 {
+		spent.Set(ec.refunds)
+	}
+	ec.refunds.Sub(ec.refunds, spent)
+	ec.lock.Unlock()
+
+	if spent.Sign() == 0 {
+		return amount
+	}
+	ec.record(Entry{Method: method, Amount: raiden.NewAmount(spent), Refund: true, Success: true})
+	return raiden.NewAmount(new(big.Int).Sub(amount.Int(), spent))
+}
@@ -0,0 +1,64 @@
+package client
+
+import (
+	"context"
+	"time"
+
+	"github.com/MariusVanDerWijden/ShareMyRPC/pricing"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// meter pays for a subscription in the background. The first notification
+// is paid for together with the subscription, every following one as soon
+// as the previous one was delivered, so the peer never has to wait for a
+// payment. If the schedule has a period, the subscription is paid for again
+// every period.
+type meter struct {
+	ec     *Client
+	kind   string
+	ticker *time.Ticker
+	period <-chan time.Time // nil if the subscription is only paid once
+}
+
+// subscribe pays for a new subscription of the kind and its first notification.
+// Connections over http are refused before anything is paid. The error of
+// the subscription has to be passed to done, see payFor.
+func (ec *Client) subscribe(ctx context.Context, kind string) (context.Context, func(error) error, error) {
+	if ec.polling {
+		return ctx, nil, rpc.ErrNotificationsUnsupported
+	}
+	return ec.payFor(ctx, pricing.SubscriptionMethod(kind), pricing.NotificationMethod(kind))
+}
+
+func (ec *Client) newMeter(kind string) *meter {
+	m := &meter{ec: ec, kind: kind}
+	if period := ec.prices().SubscriptionPeriod(); period > 0 {
+		m.ticker = time.NewTicker(period)
+		m.period = m.ticker.C
+	}
+	return m
+}
+
+// delivered pays for the next notification.
+func (m *meter) delivered() error {
+	_, done, err := m.ec.payFor(context.Background(), pricing.NotificationMethod(m.kind))
+	if err != nil {
+		return err
+	}
+	return done(nil)
+}
+
+// renew pays for the next period.
+func (m *meter) renew() error {
+	_, done, err := m.ec.payFor(context.Background(), pricing.SubscriptionMethod(m.kind))
+	if err != nil {
+		return err
+	}
+	return done(nil)
+}
+
+func (m *meter) stop() {
+	if m.ticker != nil {
+		m.ticker.Stop()
+	}
+}
@@ -2,4 +2,8 @@ module github.com/MariusVanDerWijden/ShareMyRPC
 
 go 1.14
 
-require github.com/ethereum/go-ethereum v1.9.22
+require (
+	github.com/ethereum/go-ethereum v1.9.22
+	github.com/gorilla/websocket v1.4.1-0.20190629185528-ae1634f6a989
+	github.com/naoina/toml v0.1.2-0.20170918210437-9fafd6967416
+)
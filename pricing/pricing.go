@@ -0,0 +1,282 @@
+// Package pricing implements the price schedule that is shared by the client,
+// to decide what to pay for a call, and the server, to decide what to demand.
+package pricing
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/MariusVanDerWijden/ShareMyRPC/raiden"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/naoina/toml"
+)
+
+// Subscriptions are priced by the kind of subscription, for example
+// "eth_subscribe:newHeads" or "eth_subscribe:logs". Subscriptions without
+// a price of their own cost as much as "eth_subscribe". The price is paid
+// when the subscription is created and again for every period of the
+// schedule the subscription stays open.
+//
+// Every notification delivered by a subscription costs the price of
+// "eth_subscription:<kind>", or nothing if the schedule has no such price.
+const (
+	subscribeMethod    = "eth_subscribe"
+	notificationMethod = "eth_subscription"
+)
+
+// SubscriptionMethod returns the name under which subscriptions of the kind are priced.
+func SubscriptionMethod(kind string) string {
+	return subscribeMethod + ":" + kind
+}
+
+// NotificationMethod returns the name under which the notifications
+// delivered by subscriptions of the kind are priced.
+func NotificationMethod(kind string) string {
+	return notificationMethod + ":" + kind
+}
+
+// Schedule maps JSON-RPC method names to their price in the smallest unit
+// of the token. Methods without a price of their own cost the default price.
+type Schedule struct {
+	Version string                    `json:"version"` // chosen by the operator to tell schedules apart
+	Default *raiden.Amount            `json:"default"`
+	Methods map[string]*raiden.Amount `json:"methods"`
+	Period  uint64                    `json:"period,omitempty"` // seconds after which subscriptions are charged again, 0 for never
+}
+
+// SubscriptionPeriod returns the period after which open subscriptions
+// are charged again, or 0 if they are only charged once.
+func (s *Schedule) SubscriptionPeriod() time.Duration {
+	return time.Duration(s.Period) * time.Second
+}
+
+// Offer is what a provider publishes about its prices.
+type Offer struct {
+	Schedule *Schedule `json:"schedule"`
+	Token    string    `json:"token"`   // token the provider accepts
+	Address  string    `json:"address"` // raiden address of the provider
+	Version  string    `json:"version"` // version of the schedule
+}
+
+// The costs of the default schedule.
+var (
+	generalCost         = Ether(4)
+	stateAccessCost     = Ether(5)
+	filterCost          = Ether(8)
+	contractCallingCost = Ether(3)
+	estimateGasCost     = Ether(2)
+	sendTransactionCost = Ether(1)
+	notificationCost    = Ether(1)
+)
+
+// DefaultSchedule returns the schedule that is used if none is configured.
+func DefaultSchedule() *Schedule {
+	return &Schedule{
+		Version: "default",
+		Default: generalCost,
+		Methods: map[string]*raiden.Amount{
+			"eth_chainId":     Ether(0),
+			"eth_unsubscribe": Ether(0),
+
+			"eth_getBlockByHash":                    generalCost,
+			"eth_getBlockByNumber":                  generalCost,
+			"eth_blockNumber":                       generalCost,
+			"eth_getTransactionByHash":              generalCost,
+			"eth_getTransactionByBlockHashAndIndex": generalCost,
+			"eth_getBlockTransactionCountByHash":    generalCost,
+			"eth_getTransactionReceipt":             generalCost,
+			"eth_syncing":                           generalCost,
+			"eth_subscribe":                         generalCost,
+			SubscriptionMethod("newHeads"):          generalCost,
+			NotificationMethod("newHeads"):          notificationCost,
+
+			"net_version":                          stateAccessCost,
+			"eth_getBalance":                       stateAccessCost,
+			"eth_getStorageAt":                     stateAccessCost,
+			"eth_getCode":                          stateAccessCost,
+			"eth_getTransactionCount":              stateAccessCost,
+			"eth_getBlockTransactionCountByNumber": stateAccessCost,
+
+			"eth_getLogs":              filterCost,
+			SubscriptionMethod("logs"): filterCost,
+			NotificationMethod("logs"): notificationCost,
+
+			"eth_call": contractCallingCost,
+
+			"eth_gasPrice":    estimateGasCost,
+			"eth_estimateGas": estimateGasCost,
+
+			"eth_sendRawTransaction": sendTransactionCost,
+		},
+	}
+}
+
+// Ether returns n whole tokens with 18 decimals as an amount.
+func Ether(n int64) *raiden.Amount {
+	return raiden.NewAmount(new(big.Int).Mul(big.NewInt(n), big.NewInt(params.Ether)))
+}
+
+// PeriodLimit is reported by Exceeds if a schedule charges open
+// subscriptions more often than allowed.
+const PeriodLimit = "period"
+
+// Price returns the price of the method.
+func (s *Schedule) Price(method string) *raiden.Amount {
+	if price, ok := s.lookup(method); ok {
+		return price
+	}
+	return raiden.NewAmount(new(big.Int))
+}
+
+// lookup returns the price of the method and whether the schedule sets
+// one, either for the method itself or through a fallback.
+func (s *Schedule) lookup(method string) (*raiden.Amount, bool) {
+	if price, ok := s.Methods[method]; ok {
+		return price, true
+	}
+	if strings.HasPrefix(method, subscribeMethod+":") {
+		if price, ok := s.Methods[subscribeMethod]; ok {
+			return price, true
+		}
+	}
+	if strings.HasPrefix(method, notificationMethod+":") {
+		return raiden.NewAmount(new(big.Int)), true
+	}
+	return s.Default, s.Default != nil
+}
+
+// Exceeds returns the first method that costs more in s than in max.
+// The prices in max are resolved like in Price, so methods without a
+// price in max are only limited by its default price, if it has one. The
+// default price is reported as the empty method. If s charges open
+// subscriptions more often than the period of max, PeriodLimit is
+// reported. A period of 0 in max does not limit the period.
+func (s *Schedule) Exceeds(max *Schedule) (string, bool) {
+	methods := []string{subscribeMethod}
+	for method := range s.Methods {
+		methods = append(methods, method)
+	}
+	for method := range max.Methods {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	for _, method := range methods {
+		limit, ok := max.lookup(method)
+		if ok && s.Price(method).Cmp(limit) > 0 {
+			return method, true
+		}
+	}
+	if max.Default != nil && s.Default != nil && s.Default.Cmp(max.Default) > 0 {
+		return "", true
+	}
+	if max.Period > 0 && s.Period > 0 && s.Period < max.Period {
+		return PeriodLimit, true
+	}
+	return "", false
+}
+
+// Validate returns an error if a method of the schedule has no price.
+func (s *Schedule) Validate() error {
+	for method, price := range s.Methods {
+		if price == nil {
+			return fmt.Errorf("no price for %q", method)
+		}
+	}
+	return nil
+}
+
+// Total returns the price of calling all methods.
+func (s *Schedule) Total(methods ...string) *raiden.Amount {
+	total := new(big.Int)
+	for _, method := range methods {
+		total.Add(total, s.Price(method).Int())
+	}
+	return raiden.NewAmount(total)
+}
+
+// Load loads a schedule from a JSON or TOML file, depending on its extension.
+func Load(path string) (*Schedule, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+		return ParseJSON(data)
+	case ".toml":
+		return ParseTOML(data)
+	default:
+		return nil, fmt.Errorf("unknown schedule format %q", ext)
+	}
+}
+
+// ParseJSON parses a schedule in JSON format:
+//
+//   {"version": "1", "default": "4000000000000000000", "methods": {"eth_call": "3000000000000000000"}}
+func ParseJSON(data []byte) (*Schedule, error) {
+	s := new(Schedule)
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ParseTOML parses a schedule in TOML format:
+//
+//   version = "1"
+//   default = "4000000000000000000"
+//   period = 60
+//
+//   [methods]
+//   eth_call = "3000000000000000000"
+//
+// Prices can be given as strings or as integers.
+func ParseTOML(data []byte) (*Schedule, error) {
+	var schedule struct {
+		Version string
+		Default *tomlAmount
+		Methods map[string]*tomlAmount
+		Period  uint64
+	}
+	if err := toml.Unmarshal(data, &schedule); err != nil {
+		return nil, err
+	}
+	s := &Schedule{
+		Version: schedule.Version,
+		Methods: make(map[string]*raiden.Amount),
+		Period:  schedule.Period,
+	}
+	if schedule.Default != nil {
+		s.Default = schedule.Default.Amount
+	}
+	for method, price := range schedule.Methods {
+		s.Methods[method] = price.Amount
+	}
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// tomlAmount decodes amounts from TOML strings and integers.
+type tomlAmount struct {
+	*raiden.Amount
+}
+
+func (a *tomlAmount) UnmarshalTOML(input []byte) error {
+	amount, err := raiden.ParseAmount(strings.Trim(string(input), `"'`))
+	if err != nil {
+		return err
+	}
+	a.Amount = amount
+	return nil
+}
@@ -0,0 +1,98 @@
+package pricing
+
+import (
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/MariusVanDerWijden/ShareMyRPC/raiden"
+)
+
+func TestParse(t *testing.T) {
+	tomlSchedule := `
+default = "10"
+period = 60
+
+[methods]
+eth_call = 3
+eth_subscribe = "7"
+"eth_subscribe:logs" = "100000000000000000000"
+`
+	jsonSchedule := `{"default": "10", "period": 60, "methods": {"eth_call": 3, "eth_subscribe": "7", "eth_subscribe:logs": "100000000000000000000"}}`
+
+	dir, err := ioutil.TempDir("", "pricing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, content := range map[string]string{"prices.toml": tomlSchedule, "prices.json": jsonSchedule} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		s, err := Load(path)
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		for method, want := range map[string]string{
+			"eth_call":                     "3",
+			"eth_blockNumber":              "10",
+			SubscriptionMethod("newHeads"): "7",
+			SubscriptionMethod("logs"):     "100000000000000000000",
+			NotificationMethod("logs"):     "0",
+		} {
+			if have := s.Price(method).String(); have != want {
+				t.Errorf("%v: wrong price for %v: have %v, want %v", name, method, have, want)
+			}
+		}
+		if period := s.SubscriptionPeriod(); period != time.Minute {
+			t.Errorf("%v: wrong period: %v", name, period)
+		}
+		if total := s.Total("eth_call", "eth_call", "eth_blockNumber"); total.String() != "16" {
+			t.Errorf("%v: wrong total: %v", name, total)
+		}
+	}
+}
+
+func TestParseMissingPrice(t *testing.T) {
+	if _, err := ParseJSON([]byte(`{"methods": {"eth_call": null}}`)); err == nil {
+		t.Fatal("json schedule without price parsed")
+	}
+	if _, err := ParseTOML([]byte("[methods.eth_call]\n")); err == nil {
+		t.Fatal("toml schedule without price parsed")
+	}
+}
+
+func TestExceeds(t *testing.T) {
+	max, err := ParseJSON([]byte(`{"period": 60, "methods": {"eth_call": "5", "eth_subscribe": "5"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for schedule, want := range map[string]string{
+		`{"default": "100", "methods": {"eth_call": "5", "eth_subscribe": "5"}}`:                "",
+		`{"default": "100", "period": 120, "methods": {"eth_call": "5", "eth_subscribe": "5"}}`: "",
+		`{"methods": {"eth_call": "6"}}`:                                                        "eth_call",
+		`{"default": "6", "methods": {"eth_blockNumber": "100"}}`:                               "eth_call",
+		`{"methods": {"eth_subscribe:logs": "6"}}`:                                              "eth_subscribe:logs",
+		`{"methods": {"eth_subscription:logs": "1"}}`:                                           "eth_subscription:logs",
+		`{"period": 30}`: PeriodLimit,
+	} {
+		s, err := ParseJSON([]byte(schedule))
+		if err != nil {
+			t.Fatal(err)
+		}
+		method, ok := s.Exceeds(max)
+		if ok != (want != "") || method != want {
+			t.Errorf("%v: wrong limit: have %q %v, want %q", schedule, method, ok, want)
+		}
+	}
+	// The default price of max limits the methods it does not price
+	max.Default = raiden.NewAmount(big.NewInt(10))
+	s := &Schedule{Methods: map[string]*raiden.Amount{"eth_blockNumber": raiden.NewAmount(big.NewInt(11))}}
+	if method, ok := s.Exceeds(max); !ok || method != "eth_blockNumber" {
+		t.Fatalf("wrong limit: have %q %v", method, ok)
+	}
+}
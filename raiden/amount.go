@@ -0,0 +1,59 @@
+package raiden
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+)
+
+// Amount is an arbitrary-precision token amount in the smallest unit of the token.
+// It marshals to a JSON string, and unmarshals from both JSON strings and numbers
+// as the raiden API uses both.
+type Amount big.Int
+
+// NewAmount creates a new amount from x.
+func NewAmount(x *big.Int) *Amount {
+	return (*Amount)(new(big.Int).Set(x))
+}
+
+// ParseAmount parses a decimal amount.
+func ParseAmount(s string) (*Amount, error) {
+	x, ok := new(big.Int).SetString(s, 10)
+	if !ok || x.Sign() < 0 {
+		return nil, fmt.Errorf("invalid amount %q", s)
+	}
+	return (*Amount)(x), nil
+}
+
+// Int returns the amount as a big.Int.
+func (a *Amount) Int() *big.Int {
+	return (*big.Int)(a)
+}
+
+// Cmp compares the amount to b.
+func (a *Amount) Cmp(b *Amount) int {
+	return a.Int().Cmp(b.Int())
+}
+
+func (a *Amount) String() string {
+	if a == nil {
+		return "0"
+	}
+	return a.Int().String()
+}
+
+// MarshalJSON implements json.Marshaler.
+func (a *Amount) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + a.String() + `"`), nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (a *Amount) UnmarshalJSON(input []byte) error {
+	input = bytes.Trim(input, `"`)
+	x, err := ParseAmount(string(input))
+	if err != nil {
+		return err
+	}
+	a.Int().Set(x.Int())
+	return nil
+}
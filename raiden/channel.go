@@ -0,0 +1,143 @@
+package raiden
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+var settlePollPause = time.Second
+
+// ChannelState is the state of a raiden channel.
+type ChannelState string
+
+const (
+	StateOpened   ChannelState = "opened"
+	StateClosed   ChannelState = "closed"
+	StateSettling ChannelState = "settling"
+	StateSettled  ChannelState = "settled"
+	StateUnusable ChannelState = "unusable"
+)
+
+// IsOpen returns true if payments can be made through the channel.
+func (s ChannelState) IsOpen() bool {
+	return s == StateOpened
+}
+
+// IsFinal returns true if the channel reached its final state.
+func (s ChannelState) IsFinal() bool {
+	return s == StateSettled
+}
+
+func (r *Raiden) ListChannels() ([]Opening, error) {
+	return r.ListChannelsContext(context.Background())
+}
+
+// ListChannelsContext returns all unsettled channels of the node.
+func (r *Raiden) ListChannelsContext(ctx context.Context) ([]Opening, error) {
+	var response []Opening
+	if err := r.do(ctx, "GET", "channels", nil, &response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func (r *Raiden) ListChannelsForToken(token string) ([]Opening, error) {
+	return r.ListChannelsForTokenContext(context.Background(), token)
+}
+
+// ListChannelsForTokenContext returns all unsettled channels of the node
+// in the token network.
+func (r *Raiden) ListChannelsForTokenContext(ctx context.Context, token string) ([]Opening, error) {
+	var response []Opening
+	path := fmt.Sprintf("%v/%v", "channels", token)
+	if err := r.do(ctx, "GET", path, nil, &response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// Partner is a node the raiden node has a channel with.
+type Partner struct {
+	PartnerAddress string `json:"partner_address"`
+	Channel        string `json:"channel"`
+}
+
+func (r *Raiden) ListPartners(token string) ([]Partner, error) {
+	return r.ListPartnersContext(context.Background(), token)
+}
+
+// ListPartnersContext returns all partners of the node in the token network.
+func (r *Raiden) ListPartnersContext(ctx context.Context, token string) ([]Partner, error) {
+	var response []Partner
+	path := fmt.Sprintf("%v/%v/%v", "tokens", token, "partners")
+	if err := r.do(ctx, "GET", path, nil, &response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func (r *Raiden) CloseChannel(token, other string) (*Opening, error) {
+	return r.CloseChannelContext(context.Background(), token, other)
+}
+
+// CloseChannelContext closes the channel with the partner. The channel can be
+// settled after the settle timeout passed, see WaitSettled.
+func (r *Raiden) CloseChannelContext(ctx context.Context, token, other string) (*Opening, error) {
+	type request struct {
+		State ChannelState `json:"state"`
+	}
+	req := request{
+		State: StateClosed,
+	}
+	response := new(Opening)
+	path := fmt.Sprintf("%v/%v/%v", "channels", token, other)
+	if err := r.do(ctx, "PATCH", path, req, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func (r *Raiden) Withdraw(token, other string, amount *Amount) (*Opening, error) {
+	return r.WithdrawContext(context.Background(), token, other, amount)
+}
+
+// WithdrawContext increases the total withdrawn amount of the channel to amount.
+// The tokens are sent to the on-chain account of the node.
+func (r *Raiden) WithdrawContext(ctx context.Context, token, other string, amount *Amount) (*Opening, error) {
+	type request struct {
+		TotalWithdraw *Amount `json:"total_withdraw"`
+	}
+	req := request{
+		TotalWithdraw: amount,
+	}
+	response := new(Opening)
+	path := fmt.Sprintf("%v/%v/%v", "channels", token, other)
+	if err := r.do(ctx, "PATCH", path, req, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// WaitSettled waits until the channel with the partner is settled
+// or the context is canceled. Raiden forgets about settled channels,
+// so a channel that can not be found anymore counts as settled.
+func (r *Raiden) WaitSettled(ctx context.Context, token, other string) error {
+	for {
+		channel, err := r.QueryChannelContext(ctx, token, other)
+		if IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if channel.State.IsFinal() {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(settlePollPause):
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package raiden
+
+import (
+	"context"
+	"fmt"
+)
+
+// JoinOptions are the optional parameters of joining a token network.
+// Zero values are left for the node to choose.
+type JoinOptions struct {
+	// InitialChannelTarget is the number of channels the node opens.
+	InitialChannelTarget int
+	// JoinableFundsTarget is the fraction of the funds that is used to
+	// join channels opened by other nodes.
+	JoinableFundsTarget float64
+}
+
+// Connection describes the participation of the node in a token network.
+type Connection struct {
+	Funds       *Amount `json:"funds"`
+	SumDeposits *Amount `json:"sum_deposits"`
+	Channels    int     `json:"channels,string"`
+}
+
+func (r *Raiden) JoinNetwork(token string, funds *Amount, opts *JoinOptions) error {
+	return r.JoinNetworkContext(context.Background(), token, funds, opts)
+}
+
+// JoinNetworkContext lets the connection manager of the node join
+// the token network with the given funds. The options can be nil.
+func (r *Raiden) JoinNetworkContext(ctx context.Context, token string, funds *Amount, opts *JoinOptions) error {
+	type request struct {
+		Funds                *Amount `json:"funds"`
+		InitialChannelTarget int     `json:"initial_channel_target,omitempty"`
+		JoinableFundsTarget  float64 `json:"joinable_funds_target,omitempty"`
+	}
+	req := request{
+		Funds: funds,
+	}
+	if opts != nil {
+		req.InitialChannelTarget = opts.InitialChannelTarget
+		req.JoinableFundsTarget = opts.JoinableFundsTarget
+	}
+	return r.do(ctx, "PUT", fmt.Sprintf("%v/%v", "connections", token), req, nil)
+}
+
+func (r *Raiden) ListConnections() (map[string]Connection, error) {
+	return r.ListConnectionsContext(context.Background())
+}
+
+// ListConnectionsContext returns the connections of the node,
+// keyed by the address of the token.
+func (r *Raiden) ListConnectionsContext(ctx context.Context) (map[string]Connection, error) {
+	response := make(map[string]Connection)
+	if err := r.do(ctx, "GET", "connections", nil, &response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func (r *Raiden) LeaveNetwork(token string) ([]Opening, error) {
+	return r.LeaveNetworkContext(context.Background(), token)
+}
+
+// LeaveNetworkContext lets the node leave the token network.
+// All channels in the network are closed and returned.
+func (r *Raiden) LeaveNetworkContext(ctx context.Context, token string) ([]Opening, error) {
+	var response []Opening
+	if err := r.do(ctx, "DELETE", fmt.Sprintf("%v/%v", "connections", token), nil, &response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
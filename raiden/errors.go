@@ -0,0 +1,86 @@
+package raiden
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// RaidenError is returned if the raiden node answers a request
+// with a non-successful status code.
+type RaidenError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *RaidenError) Error() string {
+	return fmt.Sprintf("raiden: %v (status %v)", e.Message, e.StatusCode)
+}
+
+// IsStatus returns true if err is a RaidenError with the given status code.
+func IsStatus(err error, status int) bool {
+	var rerr *RaidenError
+	return errors.As(err, &rerr) && rerr.StatusCode == status
+}
+
+// IsInsufficientFunds returns true if the raiden node rejected a request
+// because the channel or account did not hold enough tokens.
+func IsInsufficientFunds(err error) bool {
+	return IsStatus(err, http.StatusPaymentRequired)
+}
+
+// IsConflict returns true if the raiden node rejected a request
+// because it conflicts with the current state of the channel.
+func IsConflict(err error) bool {
+	return IsStatus(err, http.StatusConflict)
+}
+
+// IsNotFound returns true if the requested resource does not exist.
+func IsNotFound(err error) bool {
+	return IsStatus(err, http.StatusNotFound)
+}
+
+// newRaidenError decodes the error body of a raiden response.
+// Raiden reports errors as {"errors": ...}, where the value is either a
+// string, a list of strings or an object mapping fields to messages.
+func newRaidenError(status int, body []byte) *RaidenError {
+	var resp struct {
+		Errors json.RawMessage `json:"errors"`
+	}
+	msg := strings.TrimSpace(string(body))
+	if err := json.Unmarshal(body, &resp); err == nil && len(resp.Errors) > 0 {
+		msg = flattenErrors(resp.Errors)
+	}
+	if msg == "" {
+		msg = http.StatusText(status)
+	}
+	return &RaidenError{StatusCode: status, Message: msg}
+}
+
+func flattenErrors(raw json.RawMessage) string {
+	var str string
+	if err := json.Unmarshal(raw, &str); err == nil {
+		return str
+	}
+	var list []json.RawMessage
+	if err := json.Unmarshal(raw, &list); err == nil {
+		msgs := make([]string, 0, len(list))
+		for _, elem := range list {
+			msgs = append(msgs, flattenErrors(elem))
+		}
+		return strings.Join(msgs, "; ")
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err == nil {
+		msgs := make([]string, 0, len(fields))
+		for field, elem := range fields {
+			msgs = append(msgs, fmt.Sprintf("%v: %v", field, flattenErrors(elem)))
+		}
+		sort.Strings(msgs)
+		return strings.Join(msgs, "; ")
+	}
+	return string(raw)
+}
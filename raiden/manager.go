@@ -0,0 +1,248 @@
+package raiden
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/event"
+)
+
+var managerPollPause = 10 * time.Second
+
+// ChannelConfig describes when and how far a channel is topped up.
+type ChannelConfig struct {
+	Token     string
+	Partner   string
+	Threshold *Amount // the channel is topped up if its balance drops below
+	Target    *Amount // the balance the channel is topped up to
+}
+
+func (c ChannelConfig) validate() error {
+	if c.Threshold == nil || c.Target == nil {
+		return fmt.Errorf("channel with %v for token %v: threshold or target missing", c.Partner, c.Token)
+	}
+	if c.Target.Cmp(c.Threshold) < 0 {
+		return fmt.Errorf("channel with %v for token %v: target %v below threshold %v", c.Partner, c.Token, c.Target, c.Threshold)
+	}
+	return nil
+}
+
+// ChannelEventType is the type of a ChannelEvent.
+type ChannelEventType int
+
+const (
+	// LowBalance is emitted if the balance of a channel dropped below the threshold.
+	LowBalance ChannelEventType = iota
+	// DepositStarted is emitted before tokens are deposited into a channel.
+	// Payments through the channel should be paused until the deposit is done.
+	DepositStarted
+	// DepositDone is emitted after a deposit succeeded.
+	DepositDone
+	// DepositFailed is emitted after a deposit failed.
+	DepositFailed
+	// SpendingCapReached is emitted if a channel can not be topped up
+	// because the spending cap of the manager is used up.
+	SpendingCapReached
+)
+
+func (t ChannelEventType) String() string {
+	switch t {
+	case LowBalance:
+		return "low balance"
+	case DepositStarted:
+		return "deposit started"
+	case DepositDone:
+		return "deposit done"
+	case DepositFailed:
+		return "deposit failed"
+	case SpendingCapReached:
+		return "spending cap reached"
+	}
+	return "unknown"
+}
+
+// ChannelEvent is emitted by the ChannelManager.
+type ChannelEvent struct {
+	Type    ChannelEventType
+	Token   string
+	Partner string
+	Balance *Amount // balance of the channel before the deposit
+	Deposit *Amount // amount that is deposited, nil if no deposit is made
+	Err     error   // set for DepositFailed
+}
+
+// ChannelManager watches the balances of channels and tops them up when they
+// run low. The tokens deposited by the manager are limited by a spending cap.
+type ChannelManager struct {
+	node     *Raiden
+	channels []ChannelConfig
+
+	feed  event.Feed
+	scope event.SubscriptionScope
+
+	lock    sync.Mutex
+	cap     *big.Int // maximum amount of tokens to deposit
+	spent   *big.Int // amount of tokens deposited
+	pending map[string]bool
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewChannelManager creates a manager for the channels that deposits
+// at most cap tokens in total. It fails if the cap is missing or a
+// channel lacks its threshold or target.
+func NewChannelManager(node *Raiden, cap *Amount, channels ...ChannelConfig) (*ChannelManager, error) {
+	if cap == nil {
+		return nil, errors.New("spending cap missing")
+	}
+	for _, config := range channels {
+		if err := config.validate(); err != nil {
+			return nil, err
+		}
+	}
+	return &ChannelManager{
+		node:     node,
+		channels: channels,
+		cap:      new(big.Int).Set(cap.Int()),
+		spent:    new(big.Int),
+		pending:  make(map[string]bool),
+		quit:     make(chan struct{}),
+	}, nil
+}
+
+// Start starts checking the channels in the background.
+func (m *ChannelManager) Start() {
+	m.wg.Add(1)
+	go m.loop()
+}
+
+// Stop stops checking the channels and ends all subscriptions.
+func (m *ChannelManager) Stop() {
+	close(m.quit)
+	m.wg.Wait()
+	m.scope.Close()
+}
+
+// Subscribe delivers the events of the manager on ch.
+func (m *ChannelManager) Subscribe(ch chan<- ChannelEvent) event.Subscription {
+	return m.scope.Track(m.feed.Subscribe(ch))
+}
+
+// SetCap changes the spending cap of the manager.
+func (m *ChannelManager) SetCap(cap *Amount) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.cap.Set(cap.Int())
+}
+
+// Spent returns the amount of tokens deposited by the manager.
+func (m *ChannelManager) Spent() *Amount {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return NewAmount(m.spent)
+}
+
+// Pending returns true if a deposit into the channel with partner is in progress.
+func (m *ChannelManager) Pending(token, partner string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.pending[channelKey(token, partner)]
+}
+
+func (m *ChannelManager) loop() {
+	defer m.wg.Done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-m.quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	for {
+		m.Check(ctx)
+		select {
+		case <-m.quit:
+			return
+		case <-time.After(managerPollPause):
+		}
+	}
+}
+
+// Check checks all channels once and tops up the ones that run low.
+// It returns the first error that occurred.
+func (m *ChannelManager) Check(ctx context.Context) error {
+	var firstErr error
+	for _, config := range m.channels {
+		if err := m.check(ctx, config); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (m *ChannelManager) check(ctx context.Context, config ChannelConfig) error {
+	channel, err := m.node.QueryChannelContext(ctx, config.Token, config.Partner)
+	if err != nil {
+		return err
+	}
+	if !channel.State.IsOpen() || channel.Balance.Cmp(config.Threshold) >= 0 {
+		return nil
+	}
+	ev := ChannelEvent{
+		Type:    LowBalance,
+		Token:   config.Token,
+		Partner: config.Partner,
+		Balance: channel.Balance,
+	}
+	m.feed.Send(ev)
+
+	// Work out how much we can deposit within the cap
+	deposit := new(big.Int).Sub(config.Target.Int(), channel.Balance.Int())
+	key := channelKey(config.Token, config.Partner)
+	m.lock.Lock()
+	if left := new(big.Int).Sub(m.cap, m.spent); left.Cmp(deposit) < 0 {
+		deposit = left
+	}
+	if deposit.Sign() <= 0 {
+		m.lock.Unlock()
+		ev.Type = SpendingCapReached
+		m.feed.Send(ev)
+		return nil
+	}
+	m.spent.Add(m.spent, deposit)
+	m.pending[key] = true
+	m.lock.Unlock()
+
+	ev.Type, ev.Deposit = DepositStarted, NewAmount(deposit)
+	m.feed.Send(ev)
+
+	total := NewAmount(new(big.Int).Add(channel.TotalDeposit.Int(), deposit))
+	err = m.node.DepositTokenContext(ctx, config.Token, config.Partner, total)
+
+	m.lock.Lock()
+	delete(m.pending, key)
+	if err != nil {
+		m.spent.Sub(m.spent, deposit)
+	}
+	m.lock.Unlock()
+
+	ev.Type, ev.Err = DepositDone, err
+	if err != nil {
+		ev.Type = DepositFailed
+	}
+	m.feed.Send(ev)
+	return err
+}
+
+func channelKey(token, partner string) string {
+	return strings.ToLower(token) + "/" + strings.ToLower(partner)
+}
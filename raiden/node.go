@@ -0,0 +1,119 @@
+package raiden
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var readyPollPause = time.Second
+
+// NodeState is the synchronization state of a raiden node.
+type NodeState string
+
+const (
+	NodeReady       NodeState = "ready"
+	NodeSyncing     NodeState = "syncing"
+	NodeUnavailable NodeState = "unavailable"
+)
+
+var (
+	// ErrNotReady is returned if the node is not ready to serve requests.
+	ErrNotReady = errors.New("raiden node not ready")
+	// ErrWrongAddress is returned if the node runs with an unexpected account.
+	ErrWrongAddress = errors.New("raiden node runs with wrong address")
+)
+
+// NodeStatus is the status of a raiden node.
+type NodeStatus struct {
+	Status       NodeState `json:"status"`
+	BlocksToSync uint64    `json:"blocks_to_sync,string,omitempty"`
+}
+
+func (r *Raiden) Address() (string, error) {
+	return r.AddressContext(context.Background())
+}
+
+// AddressContext returns the address of the account the node runs with.
+func (r *Raiden) AddressContext(ctx context.Context) (string, error) {
+	var response struct {
+		OurAddress string `json:"our_address"`
+	}
+	if err := r.do(ctx, "GET", "address", nil, &response); err != nil {
+		return "", err
+	}
+	return response.OurAddress, nil
+}
+
+func (r *Raiden) Status() (*NodeStatus, error) {
+	return r.StatusContext(context.Background())
+}
+
+// StatusContext returns the synchronization status of the node.
+func (r *Raiden) StatusContext(ctx context.Context) (*NodeStatus, error) {
+	response := new(NodeStatus)
+	if err := r.do(ctx, "GET", "status", nil, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func (r *Raiden) Version() (string, error) {
+	return r.VersionContext(context.Background())
+}
+
+// VersionContext returns the version of the node.
+func (r *Raiden) VersionContext(ctx context.Context) (string, error) {
+	var response struct {
+		Version string `json:"version"`
+	}
+	if err := r.do(ctx, "GET", "version", nil, &response); err != nil {
+		return "", err
+	}
+	return response.Version, nil
+}
+
+// CheckReady returns an error if the node can not be reached, is not synced,
+// or runs with another account than address. An empty address matches every account.
+func (r *Raiden) CheckReady(ctx context.Context, address string) error {
+	status, err := r.StatusContext(ctx)
+	if err != nil {
+		return fmt.Errorf("raiden node at %v unreachable: %w", r.url, err)
+	}
+	switch status.Status {
+	case NodeReady:
+	case NodeSyncing:
+		return fmt.Errorf("%w: syncing, %v blocks to go", ErrNotReady, status.BlocksToSync)
+	default:
+		return fmt.Errorf("%w: %v", ErrNotReady, status.Status)
+	}
+	if address == "" {
+		return nil
+	}
+	ours, err := r.AddressContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(ours, address) {
+		return fmt.Errorf("%w: have %v, want %v", ErrWrongAddress, ours, address)
+	}
+	return nil
+}
+
+// WaitReady waits until the node is synced and ready to serve requests,
+// or the context is canceled.
+func (r *Raiden) WaitReady(ctx context.Context) error {
+	for {
+		status, err := r.StatusContext(ctx)
+		if err == nil && status.Status == NodeReady {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(readyPollPause):
+		}
+	}
+}
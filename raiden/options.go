@@ -0,0 +1,72 @@
+package raiden
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"time"
+)
+
+var (
+	defaultTimeout = 30 * time.Second
+	defaultBackoff = 500 * time.Millisecond
+)
+
+// Option configures a raiden connector.
+type Option func(*Raiden)
+
+// WithHTTPClient sets the http client that is used to talk to the node.
+func WithHTTPClient(client *http.Client) Option {
+	return func(r *Raiden) {
+		r.client = client
+	}
+}
+
+// WithTimeout sets the timeout of a single call to the node.
+// A timeout of zero disables it.
+func WithTimeout(timeout time.Duration) Option {
+	return func(r *Raiden) {
+		r.timeout = timeout
+	}
+}
+
+// WithRetries retries failed GET requests up to retries times. The pause
+// between two attempts starts at backoff and is doubled on every retry.
+func WithRetries(retries int, backoff time.Duration) Option {
+	return func(r *Raiden) {
+		r.retries = retries
+		r.backoff = backoff
+	}
+}
+
+// WithHeader adds a header to every request,
+// for example to authenticate against a reverse proxy.
+func WithHeader(key, value string) Option {
+	return func(r *Raiden) {
+		r.header.Add(key, value)
+	}
+}
+
+// WithBasicAuth authenticates every request with the username and password.
+func WithBasicAuth(username, password string) Option {
+	auth := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+	return WithHeader("Authorization", "Basic "+auth)
+}
+
+// WithBearerToken authenticates every request with the token.
+func WithBearerToken(token string) Option {
+	return WithHeader("Authorization", "Bearer "+token)
+}
+
+// retryable returns true if the request might succeed when sent again.
+func retryable(err error) bool {
+	var rerr *RaidenError
+	if errors.As(err, &rerr) {
+		switch rerr.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout, http.StatusTooManyRequests:
+			return true
+		}
+		return false
+	}
+	return true
+}
@@ -2,81 +2,150 @@ package raiden
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
+	"time"
 )
 
+// Raiden is a connector to the REST API of a raiden node.
+// Non-successful responses of the node are reported as *RaidenError.
+// Methods that take no context have a variant with a Context suffix.
 type Raiden struct {
-	url string
+	url     string
+	client  *http.Client
+	timeout time.Duration // timeout of a single call, zero for none
+	retries int           // number of retries of idempotent calls
+	backoff time.Duration // pause before the first retry, doubled on each retry
+	header  http.Header   // extra headers sent with every request
 }
 
 // NewRaiden creates a new raiden connector with the given url.
 // Ex. http://localhost:5001/api/v1
-func NewRaiden(url string) *Raiden {
-	return &Raiden{
-		url: url,
+func NewRaiden(url string, opts ...Option) *Raiden {
+	r := &Raiden{
+		url:     url,
+		client:  http.DefaultClient,
+		timeout: defaultTimeout,
+		backoff: defaultBackoff,
+		header:  make(http.Header),
 	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
 }
 
-func Req(method, url string, data []byte) (*http.Response, error) {
-	reader := bytes.NewReader(data)
-	req, err := http.NewRequest(method, url, reader)
-	if err != nil {
-		return nil, err
+// call sends a request to the endpoint at path and returns the response body.
+// If the node answers with a non-successful status code,
+// the error message of the node is returned as *RaidenError.
+// Failed GET requests are retried with backoff.
+func (r *Raiden) call(ctx context.Context, method, path string, request interface{}) ([]byte, error) {
+	var data []byte
+	if request != nil {
+		var err error
+		if data, err = json.Marshal(request); err != nil {
+			return nil, err
+		}
+	}
+	url := fmt.Sprintf("%v/%v", r.url, path)
+	retries := 0
+	if method == "GET" {
+		retries = r.retries
+	}
+	backoff := r.backoff
+	for attempt := 0; ; attempt++ {
+		body, err := r.send(ctx, method, url, data)
+		if err == nil || attempt >= retries || !retryable(err) {
+			return body, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
 	}
-	req.Header.Set("Content-Type", "application/json")
-	return http.DefaultClient.Do(req)
 }
 
-func (r *Raiden) GetTokenList() ([]byte, error) {
-	url := fmt.Sprintf("%v/%v", r.url, "tokens")
-	resp, err := http.Get(url)
+// send sends a single request and reads the response body.
+func (r *Raiden) send(ctx context.Context, method, url string, data []byte) ([]byte, error) {
+	if r.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(data))
 	if err != nil {
 		return nil, err
 	}
-	return ioutil.ReadAll(resp.Body)
-}
-
-func (r *Raiden) JoinNetwork(token, funds string) ([]byte, error) {
-	type request struct {
-		Funds string `json:"funds"`
-	}
-	req := request{
-		Funds: funds,
+	for key, values := range r.header {
+		req.Header[key] = values
 	}
-	data, err := json.Marshal(req)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := r.client.Do(req)
 	if err != nil {
 		return nil, err
 	}
-	url := fmt.Sprintf("%v/%v/%v", r.url, "connections", token)
-	resp, err := Req("PUT", url, data)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
 	}
-	return ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, newRaidenError(resp.StatusCode, body)
+	}
+	return body, nil
+}
+
+// do sends a request to the endpoint at path and decodes the response into result.
+func (r *Raiden) do(ctx context.Context, method, path string, request, result interface{}) error {
+	body, err := r.call(ctx, method, path, request)
+	if err != nil {
+		return err
+	}
+	if result == nil || len(bytes.TrimSpace(body)) == 0 {
+		return nil
+	}
+	return json.Unmarshal(body, result)
+}
+
+func (r *Raiden) GetTokenList() ([]byte, error) {
+	return r.GetTokenListContext(context.Background())
+}
+
+// GetTokenListContext returns the list of registered tokens.
+func (r *Raiden) GetTokenListContext(ctx context.Context) ([]byte, error) {
+	return r.call(ctx, "GET", "tokens", nil)
 }
 
 type Opening struct {
-	TokenAddress        string `json:"token_address"`
-	PartnerAddress      string `json:"partner_address"`
-	SettleTimeout       string `json:"settle_timeout"`
-	RevealTimeout       string `json:"reveal_timeout"`
-	Balance             string `json:"balance"`
-	TokenNetworkAddress string `json:"token_network_address"`
-	TotalDeposit        string `json:"total_deposit"`
-	State               string `json:"state"`
-	ChannelIdentifier   string `json:"channel_identifier"`
-	TotalWithdraw       string `json:"total_withdraw"`
-}
-
-func (r *Raiden) OpenChannel(partner, token, deposit, timeout string) (*Opening, error) {
+	TokenAddress        string       `json:"token_address"`
+	PartnerAddress      string       `json:"partner_address"`
+	SettleTimeout       string       `json:"settle_timeout"`
+	RevealTimeout       string       `json:"reveal_timeout"`
+	Balance             *Amount      `json:"balance"`
+	TokenNetworkAddress string       `json:"token_network_address"`
+	TotalDeposit        *Amount      `json:"total_deposit"`
+	State               ChannelState `json:"state"`
+	ChannelIdentifier   string       `json:"channel_identifier"`
+	TotalWithdraw       *Amount      `json:"total_withdraw"`
+}
+
+func (r *Raiden) OpenChannel(partner, token string, deposit *Amount, timeout string) (*Opening, error) {
+	return r.OpenChannelContext(context.Background(), partner, token, deposit, timeout)
+}
+
+// OpenChannelContext opens a channel with the partner and deposits into it.
+func (r *Raiden) OpenChannelContext(ctx context.Context, partner, token string, deposit *Amount, timeout string) (*Opening, error) {
 	type request struct {
-		PartnerAddress string `json:"partner_address"`
-		TokenAddress   string `json:"token_address"`
-		TotalDeposit   string `json:"total_deposit"`
-		SettleTimeout  string `json:"settle_timeout"`
+		PartnerAddress string  `json:"partner_address"`
+		TokenAddress   string  `json:"token_address"`
+		TotalDeposit   *Amount `json:"total_deposit"`
+		SettleTimeout  string  `json:"settle_timeout"`
 	}
 	req := request{
 		PartnerAddress: partner,
@@ -84,84 +153,157 @@ func (r *Raiden) OpenChannel(partner, token, deposit, timeout string) (*Opening,
 		TokenAddress:   token,
 		TotalDeposit:   deposit,
 	}
-	data, err := json.Marshal(req)
-	if err != nil {
-		return nil, err
-	}
-	url := fmt.Sprintf("%v/%v", r.url, "channels")
-	resp, err := Req("PUT", url, data)
-	if err != nil {
+	response := new(Opening)
+	if err := r.do(ctx, "PUT", "channels", req, response); err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-	response := new(Opening)
-	return response, json.NewDecoder(resp.Body).Decode(response)
+	return response, nil
 }
 
 func (r *Raiden) QueryChannel(token, other string) (*Opening, error) {
-	url := fmt.Sprintf("%v/%v/%v/%v", r.url, "channels", token, other)
-	resp, err := http.Get(url)
-	if err != nil {
+	return r.QueryChannelContext(context.Background(), token, other)
+}
+
+// QueryChannelContext returns the channel with the partner in the token network.
+func (r *Raiden) QueryChannelContext(ctx context.Context, token, other string) (*Opening, error) {
+	response := new(Opening)
+	path := fmt.Sprintf("%v/%v/%v", "channels", token, other)
+	if err := r.do(ctx, "GET", path, nil, response); err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-	response := new(Opening)
-	return response, json.NewDecoder(resp.Body).Decode(response)
+	return response, nil
+}
+
+func (r *Raiden) DepositToken(token, other string, amount *Amount) error {
+	return r.DepositTokenContext(context.Background(), token, other, amount)
 }
 
-func (r *Raiden) DepositToken(token, other, amount string) error {
+// DepositTokenContext increases the total deposit of the channel to amount.
+func (r *Raiden) DepositTokenContext(ctx context.Context, token, other string, amount *Amount) error {
 	type request struct {
-		TotalDeposit string `json:"total_deposit"`
+		TotalDeposit *Amount `json:"total_deposit"`
 	}
 	req := request{
 		TotalDeposit: amount,
 	}
-	data, err := json.Marshal(req)
+	path := fmt.Sprintf("%v/%v/%v", "channels", token, other)
+	return r.do(ctx, "PATCH", path, req, nil)
+}
+
+// PaymentID identifies a payment. It marshals to a JSON string, and
+// unmarshals from both JSON strings and numbers as the raiden API uses both.
+type PaymentID uint64
+
+func (id PaymentID) String() string {
+	return strconv.FormatUint(uint64(id), 10)
+}
+
+// MarshalJSON implements json.Marshaler.
+func (id PaymentID) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + id.String() + `"`), nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (id *PaymentID) UnmarshalJSON(input []byte) error {
+	input = bytes.Trim(input, `"`)
+	if len(input) == 0 {
+		*id = 0
+		return nil
+	}
+	v, err := strconv.ParseUint(string(input), 10, 64)
 	if err != nil {
-		return err
+		return fmt.Errorf("invalid payment identifier %q", input)
 	}
-	url := fmt.Sprintf("%v/%v/%v/%v", r.url, "channels", token, other)
-	_, err = Req("PATCH", url, data)
-	return err
+	*id = PaymentID(v)
+	return nil
 }
 
-func (r *Raiden) PayToken(token, other, amount string) (string, error) {
+// PaymentOptions are the optional parameters of a payment.
+// Zero values are left for the node to choose.
+type PaymentOptions struct {
+	Identifier  PaymentID
+	Secret      string
+	SecretHash  string
+	LockTimeout uint64
+}
+
+// Payment is a payment that was initiated by the node.
+type Payment struct {
+	Identifier       PaymentID `json:"identifier"`
+	Secret           string    `json:"secret"`
+	SecretHash       string    `json:"secret_hash"`
+	InitiatorAddress string    `json:"initiator_address"`
+	TargetAddress    string    `json:"target_address"`
+	TokenAddress     string    `json:"token_address"`
+	Amount           *Amount   `json:"amount"`
+}
+
+func (r *Raiden) PayToken(token, other string, amount *Amount, opts *PaymentOptions) (*Payment, error) {
+	return r.PayTokenContext(context.Background(), token, other, amount, opts)
+}
+
+// PayTokenContext sends amount tokens to the target.
+// The options can be nil.
+func (r *Raiden) PayTokenContext(ctx context.Context, token, other string, amount *Amount, opts *PaymentOptions) (*Payment, error) {
 	fmt.Printf("Sending %v to %v in token %v\n", amount, other, token)
 	type request struct {
-		Amount string `json:"amount"`
+		Amount      *Amount   `json:"amount"`
+		Identifier  PaymentID `json:"identifier,omitempty"`
+		Secret      string    `json:"secret,omitempty"`
+		SecretHash  string    `json:"secret_hash,omitempty"`
+		LockTimeout uint64    `json:"lock_timeout,omitempty"`
 	}
 	req := request{
 		Amount: amount,
 	}
-	data, err := json.Marshal(req)
-	if err != nil {
-		return "", err
+	if opts != nil {
+		req.Identifier = opts.Identifier
+		req.Secret = opts.Secret
+		req.SecretHash = opts.SecretHash
+		req.LockTimeout = opts.LockTimeout
 	}
-	url := fmt.Sprintf("%v/%v/%v/%v", r.url, "payments", token, other)
-	resp, err := Req("POST", url, data)
-	type Message struct {
-		Message string `json:"message"`
+	response := new(Payment)
+	path := fmt.Sprintf("%v/%v/%v", "payments", token, other)
+	if err := r.do(ctx, "POST", path, req, response); err != nil {
+		return nil, err
 	}
-	response := new(Message)
-	return response.Message, json.NewDecoder(resp.Body).Decode(response)
+	return response, nil
 }
 
-type PaymentHistory []struct {
-	Identifier   string `json:"identifier"`
-	LogTime      string `json:"log_time"`
-	Target       string `json:"target"`
-	Amount       string `json:"amount"`
-	Event        string `json:"event"`
-	TokenAddress string `json:"token_address"`
+// The event types of the payment history.
+const (
+	EventPaymentSentSuccess     = "EventPaymentSentSuccess"
+	EventPaymentSentFailed      = "EventPaymentSentFailed"
+	EventPaymentReceivedSuccess = "EventPaymentReceivedSuccess"
+)
+
+// PaymentEvent is an entry of the payment history.
+type PaymentEvent struct {
+	Identifier   PaymentID `json:"identifier"`
+	Initiator    string    `json:"initiator"`
+	LogTime      string    `json:"log_time"`
+	Target       string    `json:"target"`
+	Amount       *Amount   `json:"amount"`
+	Event        string    `json:"event"`
+	TokenAddress string    `json:"token_address"`
 }
 
+type PaymentHistory []PaymentEvent
+
 func (r *Raiden) PaymentHistory(token, other string) (*PaymentHistory, error) {
-	url := fmt.Sprintf("%v/%v/%v/%v", r.url, "payments", token, other)
-	resp, err := http.Get(url)
-	if err != nil {
+	return r.PaymentHistoryContext(context.Background(), token, other)
+}
+
+// PaymentHistoryContext returns all payment events with the partner in the token network.
+// If other is empty, the payment events with all partners are returned.
+func (r *Raiden) PaymentHistoryContext(ctx context.Context, token, other string) (*PaymentHistory, error) {
+	response := new(PaymentHistory)
+	path := fmt.Sprintf("%v/%v", "payments", token)
+	if other != "" {
+		path = fmt.Sprintf("%v/%v", path, other)
+	}
+	if err := r.do(ctx, "GET", path, nil, response); err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-	response := new(PaymentHistory)
-	return response, json.NewDecoder(resp.Body).Decode(response)
+	return response, nil
 }
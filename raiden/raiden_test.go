@@ -1,80 +1,492 @@
 package raiden
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
+
+	"github.com/MariusVanDerWijden/ShareMyRPC/raidentest"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+var (
+	token     = "0x95B2d84De40a0121061b105E6B54016a49621B44"
+	raidenhub = "0x1F916ab5cf1B30B22f24Ebf435f53Ee665344Acf"
+	us        = "0x0000000000000000000000000000000000000001"
 )
 
+// newTestNetwork creates a fake network with our node and the raiden hub.
+func newTestNetwork(t *testing.T) (*raidentest.Network, *Raiden) {
+	network := raidentest.NewNetwork()
+	network.AddToken(token)
+	node := network.NewNode(us)
+	network.NewNode(raidenhub)
+	t.Cleanup(network.Close)
+	return network, NewRaiden(node.URL())
+}
+
 func TestGetTokenList(t *testing.T) {
-	url := "http://localhost:5001/api/v1"
-	r := NewRaiden(url)
+	_, r := newTestNetwork(t)
 	out, err := r.GetTokenList()
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
+	}
+	var tokens []string
+	if err := json.Unmarshal(out, &tokens); err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 1 || tokens[0] != token {
+		t.Fatalf("wrong token list: %v", tokens)
 	}
-	data := string(out)
-	t.Error(data)
 }
 
 func TestJoinNetwork(t *testing.T) {
-	url := "http://localhost:5001/api/v1"
-	token := "0x95B2d84De40a0121061b105E6B54016a49621B44"
-	funds := "100"
-	r := NewRaiden(url)
-	out, err := r.JoinNetwork(token, funds)
+	_, r := newTestNetwork(t)
+	funds := NewAmount(big.NewInt(100))
+	opts := &JoinOptions{InitialChannelTarget: 3, JoinableFundsTarget: 0.4}
+	if err := r.JoinNetwork(token, funds, opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.OpenChannel(raidenhub, token, NewAmount(big.NewInt(10)), "500"); err != nil {
+		t.Fatal(err)
+	}
+	connections, err := r.ListConnections()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, ok := connections[token]
+	if !ok || conn.Funds.Cmp(funds) != 0 || conn.Channels != 1 || conn.SumDeposits.Int().Int64() != 10 {
+		t.Fatalf("wrong connections: %+v", connections)
+	}
+	closed, err := r.LeaveNetwork(token)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
+	}
+	if len(closed) != 1 || closed[0].State != StateClosed {
+		t.Fatalf("wrong closed channels: %+v", closed)
+	}
+	if _, err := r.LeaveNetwork(token); !IsConflict(err) {
+		t.Fatalf("expected conflict, got %v", err)
 	}
-	data := string(out)
-	t.Error(data)
 }
 
 func TestOpenChannel(t *testing.T) {
-	url := "http://localhost:5001/api/v1"
-	token := "0x95B2d84De40a0121061b105E6B54016a49621B44"
-	raidenhub := "0x1F916ab5cf1B30B22f24Ebf435f53Ee665344Acf"
-	deposit := "10"
+	_, r := newTestNetwork(t)
+	deposit := NewAmount(big.NewInt(10))
 	timeout := "1000"
-	r := NewRaiden(url)
 	open, err := r.OpenChannel(raidenhub, token, deposit, timeout)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
+	}
+	if open.Balance.Cmp(deposit) != 0 || open.State != StateOpened || open.SettleTimeout != timeout {
+		t.Fatalf("wrong channel: %+v", open)
+	}
+	if _, err := r.OpenChannel(raidenhub, token, deposit, timeout); !IsConflict(err) {
+		t.Fatalf("expected conflict, got %v", err)
 	}
-	t.Error(open.Balance)
 }
 
 func TestPayToken(t *testing.T) {
-	url := "http://localhost:5001/api/v1"
-	token := "0x95B2d84De40a0121061b105E6B54016a49621B44"
-	raidenhub := "0x1F916ab5cf1B30B22f24Ebf435f53Ee665344Acf"
-	r := NewRaiden(url)
-	msg, err := r.PayToken(token, raidenhub, "1")
+	_, r := newTestNetwork(t)
+	if _, err := r.OpenChannel(raidenhub, token, NewAmount(big.NewInt(10)), "500"); err != nil {
+		t.Fatal(err)
+	}
+	payment, err := r.PayToken(token, raidenhub, NewAmount(big.NewInt(1)), &PaymentOptions{Identifier: 42})
 	if err != nil {
 		t.Fatal(err)
 	}
-	t.Fatal(msg)
+	if payment.Identifier != 42 || payment.Amount.Int().Int64() != 1 || payment.Secret == "" {
+		t.Fatalf("wrong payment: %+v", payment)
+	}
+	if _, err := r.PayToken(token, raidenhub, NewAmount(big.NewInt(10)), nil); !IsInsufficientFunds(err) {
+		t.Fatalf("expected insufficient funds, got %v", err)
+	}
+}
+
+func TestPayTokenMediated(t *testing.T) {
+	network, r := newTestNetwork(t)
+	target := network.NewNode("0x02")
+	if _, err := r.OpenChannel(raidenhub, token, NewAmount(big.NewInt(10)), "500"); err != nil {
+		t.Fatal(err)
+	}
+	hub := NewRaiden(network.Node(raidenhub).URL())
+	if _, err := hub.OpenChannel(target.Address.Hex(), token, NewAmount(big.NewInt(5)), "500"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.PayToken(token, target.Address.Hex(), NewAmount(big.NewInt(3)), nil); err != nil {
+		t.Fatal(err)
+	}
+	if balance := target.Balance(token, raidenhub); balance.Int64() != 3 {
+		t.Fatalf("wrong target balance: %v", balance)
+	}
+	history, err := NewRaiden(target.URL()).PaymentHistory(token, us)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*history) != 1 || (*history)[0].Event != EventPaymentReceivedSuccess {
+		t.Fatalf("wrong history: %+v", history)
+	}
 }
 
 func TestQueryChannel(t *testing.T) {
-	url := "http://localhost:5001/api/v1"
-	token := "0x95B2d84De40a0121061b105E6B54016a49621B44"
-	raidenhub := "0x1F916ab5cf1B30B22f24Ebf435f53Ee665344Acf"
-	r := NewRaiden(url)
+	_, r := newTestNetwork(t)
+	if _, err := r.QueryChannel(token, raidenhub); !IsNotFound(err) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+	if _, err := r.OpenChannel(raidenhub, token, NewAmount(big.NewInt(10)), "500"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.DepositToken(token, raidenhub, NewAmount(big.NewInt(15))); err != nil {
+		t.Fatal(err)
+	}
 	open, err := r.QueryChannel(token, raidenhub)
 	if err != nil {
 		t.Fatal(err)
 	}
-	fmt.Print(open)
+	if open.TotalDeposit.Int().Int64() != 15 || open.Balance.Int().Int64() != 15 {
+		t.Fatalf("wrong channel: %+v", open)
+	}
+}
+
+func TestChannelLifecycle(t *testing.T) {
+	network, r := newTestNetwork(t)
+	network.SettleDelay = 50 * time.Millisecond
+	oldPause := settlePollPause
+	settlePollPause = 10 * time.Millisecond
+	t.Cleanup(func() { settlePollPause = oldPause })
+	if _, err := r.OpenChannel(raidenhub, token, NewAmount(big.NewInt(10)), "500"); err != nil {
+		t.Fatal(err)
+	}
+	open, err := r.Withdraw(token, raidenhub, NewAmount(big.NewInt(4)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if open.Balance.Int().Int64() != 6 || open.TotalWithdraw.Int().Int64() != 4 {
+		t.Fatalf("wrong channel after withdraw: %+v", open)
+	}
+	closed, err := r.CloseChannel(token, raidenhub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if closed.State != StateClosed {
+		t.Fatalf("wrong state after close: %v", closed.State)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := r.WaitSettled(ctx, token, raidenhub); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListChannels(t *testing.T) {
+	network, r := newTestNetwork(t)
+	other := "0x5B2d84De40a0121061b105E6B54016a49621B449"
+	network.AddToken(other)
+	if _, err := r.OpenChannel(raidenhub, token, NewAmount(big.NewInt(10)), "500"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.OpenChannel(raidenhub, other, NewAmount(big.NewInt(10)), "500"); err != nil {
+		t.Fatal(err)
+	}
+	channels, err := r.ListChannels()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(channels) != 2 {
+		t.Fatalf("wrong number of channels: %v", len(channels))
+	}
+	channels, err = r.ListChannelsForToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(channels) != 1 || channels[0].PartnerAddress != raidenhub {
+		t.Fatalf("wrong channels: %+v", channels)
+	}
+	partners, err := r.ListPartners(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(partners) != 1 || partners[0].PartnerAddress != raidenhub {
+		t.Fatalf("wrong partners: %+v", partners)
+	}
 }
 
 func TestPaymentHistory(t *testing.T) {
-	url := "http://localhost:5001/api/v1"
-	token := "0x95B2d84De40a0121061b105E6B54016a49621B44"
-	raidenhub := "0x1F916ab5cf1B30B22f24Ebf435f53Ee665344Acf"
-	r := NewRaiden(url)
-	open, err := r.PaymentHistory(token, raidenhub)
+	_, r := newTestNetwork(t)
+	if _, err := r.OpenChannel(raidenhub, token, NewAmount(big.NewInt(10)), "500"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.PayToken(token, raidenhub, NewAmount(big.NewInt(2)), nil); err != nil {
+		t.Fatal(err)
+	}
+	history, err := r.PaymentHistory(token, raidenhub)
 	if err != nil {
 		t.Fatal(err)
 	}
-	fmt.Print(open)
+	if len(*history) != 1 {
+		t.Fatalf("wrong history length: %v", len(*history))
+	}
+	if entry := (*history)[0]; entry.Event != EventPaymentSentSuccess || entry.Target != raidenhub || entry.Amount.Int().Int64() != 2 {
+		t.Fatalf("wrong history entry: %+v", entry)
+	}
+}
+
+func TestRaidenError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusPaymentRequired)
+		fmt.Fprint(w, `{"errors": "Insufficient balance"}`)
+	}))
+	defer srv.Close()
+	r := NewRaiden(srv.URL)
+	_, err := r.PayTokenContext(context.Background(), "0x01", "0x02", NewAmount(big.NewInt(1)), nil)
+	if !IsInsufficientFunds(err) {
+		t.Fatalf("expected insufficient funds, got %v", err)
+	}
+	if err.(*RaidenError).Message != "Insufficient balance" {
+		t.Fatalf("wrong message: %v", err)
+	}
+	_, err = r.QueryChannelContext(context.Background(), "0x01", "0x02")
+	if IsNotFound(err) || !IsStatus(err, http.StatusPaymentRequired) {
+		t.Fatalf("wrong status: %v", err)
+	}
+}
+
+func TestAmountJSON(t *testing.T) {
+	var opening Opening
+	input := `{"balance": "100000000000000000000000", "total_deposit": 42, "total_withdraw": null}`
+	if err := json.Unmarshal([]byte(input), &opening); err != nil {
+		t.Fatal(err)
+	}
+	if opening.Balance.String() != "100000000000000000000000" {
+		t.Fatalf("wrong balance: %v", opening.Balance)
+	}
+	if opening.TotalDeposit.Int().Int64() != 42 {
+		t.Fatalf("wrong deposit: %v", opening.TotalDeposit)
+	}
+	if opening.TotalWithdraw != nil {
+		t.Fatalf("expected nil withdraw, got %v", opening.TotalWithdraw)
+	}
+	out, err := json.Marshal(opening.Balance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != `"100000000000000000000000"` {
+		t.Fatalf("wrong encoding: %s", out)
+	}
+	if err := json.Unmarshal([]byte(`"-1"`), new(Amount)); err == nil {
+		t.Fatal("negative amount accepted")
+	}
+}
+
+func TestPaymentWatcherPoll(t *testing.T) {
+	history := `[{"event": "EventPaymentReceivedSuccess", "identifier": "1", "log_time": "2020-10-01T10:00:00.000000", "amount": "5"}]`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, history)
+	}))
+	defer srv.Close()
+
+	w := NewPaymentWatcher(NewRaiden(srv.URL), "0x01", "0x02")
+	if payments, err := w.Poll(context.Background()); err != nil || len(payments) != 1 {
+		t.Fatalf("wrong initial poll: %v %v", payments, err)
+	}
+	// Two payments arrive at the same time, one of them was sent by us
+	history = `[
+		{"event": "EventPaymentReceivedSuccess", "identifier": "1", "log_time": "2020-10-01T10:00:00.000000", "amount": "5"},
+		{"event": "EventPaymentReceivedSuccess", "identifier": "2", "log_time": "2020-10-01T10:00:01.000000", "amount": "6"},
+		{"event": "EventPaymentReceivedSuccess", "identifier": "3", "log_time": "2020-10-01T10:00:01.000000", "amount": "7"},
+		{"event": "EventPaymentSentSuccess", "identifier": "4", "log_time": "2020-10-01T10:00:02.000000", "amount": "8"}
+	]`
+	payments, err := w.Poll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payments) != 2 || payments[0].Identifier != 2 || payments[1].Identifier != 3 {
+		t.Fatalf("wrong payments: %v", payments)
+	}
+	if payments, err := w.Poll(context.Background()); err != nil || len(payments) != 0 {
+		t.Fatalf("payments delivered twice: %v %v", payments, err)
+	}
+}
+
+func TestPaymentWatcherBackoff(t *testing.T) {
+	defer func(pause time.Duration) { watchPollPause = pause }(watchPollPause)
+	watchPollPause = 10 * time.Millisecond
+	polls := make(chan struct{}, 100)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		polls <- struct{}{}
+		fmt.Fprint(w, `[]`)
+	}))
+	defer srv.Close()
+
+	w := NewPaymentWatcher(NewRaiden(srv.URL), "0x01", "0x02")
+	if err := w.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+	// The unchanged history is polled less and less often
+	time.Sleep(400 * time.Millisecond)
+	if n := len(polls); n > 10 {
+		t.Fatalf("no backoff: %d polls", n)
+	}
+	for len(polls) > 0 {
+		<-polls
+	}
+	// Waking polls right away
+	w.Wake()
+	select {
+	case <-polls:
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("no poll after wake")
+	}
+}
+
+func TestOptions(t *testing.T) {
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if user, pass, ok := r.BasicAuth(); !ok || user != "user" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if calls < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, `[]`)
+	}))
+	defer srv.Close()
+
+	r := NewRaiden(srv.URL, WithBasicAuth("user", "secret"), WithRetries(3, time.Millisecond))
+	if _, err := r.ListChannels(); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 {
+		t.Fatalf("wrong number of calls: %v", calls)
+	}
+	// Payments are not idempotent and must not be retried
+	calls = 0
+	if _, err := r.PayToken(token, raidenhub, NewAmount(big.NewInt(1)), nil); !IsStatus(err, http.StatusServiceUnavailable) {
+		t.Fatalf("expected unavailable, got %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("payment retried: %v calls", calls)
+	}
+	// Calls time out
+	r = NewRaiden(srv.URL, WithTimeout(time.Nanosecond))
+	if _, err := r.ListChannels(); err == nil {
+		t.Fatal("expected timeout")
+	}
+}
+
+func TestChannelManager(t *testing.T) {
+	_, r := newTestNetwork(t)
+	if _, err := r.OpenChannel(raidenhub, token, NewAmount(big.NewInt(10)), "500"); err != nil {
+		t.Fatal(err)
+	}
+	config := ChannelConfig{
+		Token:     token,
+		Partner:   raidenhub,
+		Threshold: NewAmount(big.NewInt(5)),
+		Target:    NewAmount(big.NewInt(10)),
+	}
+	m, err := NewChannelManager(r, NewAmount(big.NewInt(6)), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan ChannelEvent, 16)
+	sub := m.Subscribe(events)
+	defer sub.Unsubscribe()
+
+	// Enough balance, nothing to do
+	if err := m.Check(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 0 {
+		t.Fatalf("unexpected event: %v", (<-events).Type)
+	}
+	// Low balance, top up within the cap
+	if _, err := r.PayToken(token, raidenhub, NewAmount(big.NewInt(8)), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Check(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []ChannelEventType{LowBalance, DepositStarted, DepositDone} {
+		if ev := <-events; ev.Type != want {
+			t.Fatalf("wrong event: have %v, want %v", ev.Type, want)
+		}
+	}
+	channel, err := r.QueryChannel(token, raidenhub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if channel.Balance.Int().Int64() != 8 || m.Spent().Int().Int64() != 6 {
+		t.Fatalf("wrong top up: balance %v, spent %v", channel.Balance, m.Spent())
+	}
+	// Low balance, cap used up
+	if _, err := r.PayToken(token, raidenhub, NewAmount(big.NewInt(4)), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Check(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []ChannelEventType{LowBalance, SpendingCapReached} {
+		if ev := <-events; ev.Type != want {
+			t.Fatalf("wrong event: have %v, want %v", ev.Type, want)
+		}
+	}
+	// Incomplete configs are rejected
+	if _, err := NewChannelManager(r, nil, config); err == nil {
+		t.Fatal("expected error for missing cap")
+	}
+	for _, invalid := range []ChannelConfig{
+		{Token: token, Partner: raidenhub, Target: config.Target},
+		{Token: token, Partner: raidenhub, Threshold: config.Threshold},
+		{Token: token, Partner: raidenhub, Threshold: config.Target, Target: config.Threshold},
+	} {
+		if _, err := NewChannelManager(r, NewAmount(big.NewInt(6)), config, invalid); err == nil {
+			t.Fatalf("expected error for %+v", invalid)
+		}
+	}
+}
+
+func TestNodeReadiness(t *testing.T) {
+	network := raidentest.NewNetwork()
+	defer network.Close()
+	node := network.NewNode(us)
+	r := NewRaiden(node.URL())
+
+	if addr, err := r.Address(); err != nil || addr != common.HexToAddress(us).Hex() {
+		t.Fatalf("wrong address: %v %v", addr, err)
+	}
+	if version, err := r.Version(); err != nil || version != raidentest.Version {
+		t.Fatalf("wrong version: %v %v", version, err)
+	}
+	if err := r.CheckReady(context.Background(), us); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.CheckReady(context.Background(), raidenhub); !errors.Is(err, ErrWrongAddress) {
+		t.Fatalf("expected wrong address, got %v", err)
+	}
+	node.SetStatus("syncing", 12)
+	status, err := r.Status()
+	if err != nil || status.Status != NodeSyncing || status.BlocksToSync != 12 {
+		t.Fatalf("wrong status: %+v %v", status, err)
+	}
+	if err := r.CheckReady(context.Background(), ""); !errors.Is(err, ErrNotReady) {
+		t.Fatalf("expected not ready, got %v", err)
+	}
+	readyPollPause = 10 * time.Millisecond
+	time.AfterFunc(50*time.Millisecond, func() { node.SetStatus("ready", 0) })
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := r.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
 }
@@ -0,0 +1,151 @@
+package raiden
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/event"
+)
+
+var (
+	watchPollPause    = 100 * time.Millisecond
+	watchMaxPollPause = 5 * time.Second
+)
+
+// PaymentWatcher watches the payment history of a raiden node and delivers
+// every newly received payment exactly once to all of its subscribers.
+// It remembers the log time and identifiers of the last seen payments,
+// so payments that arrive between two polls are not missed. While no
+// payments arrive, the watcher polls less and less often until it is woken.
+type PaymentWatcher struct {
+	node    *Raiden
+	token   string
+	partner string
+
+	feed  event.Feed
+	scope event.SubscriptionScope
+
+	lastTime string             // log time of the newest seen payment
+	lastIDs  map[PaymentID]bool // identifiers of the payments seen at lastTime
+
+	wake chan struct{}
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewPaymentWatcher creates a watcher for the payments received from partner
+// in the token network. If partner is empty, the payments from all
+// partners are watched.
+func NewPaymentWatcher(node *Raiden, token, partner string) *PaymentWatcher {
+	return &PaymentWatcher{
+		node:    node,
+		token:   token,
+		partner: partner,
+		lastIDs: make(map[PaymentID]bool),
+		wake:    make(chan struct{}, 1),
+		quit:    make(chan struct{}),
+	}
+}
+
+// Start marks the current payment history as seen and starts watching
+// for new payments in the background.
+func (w *PaymentWatcher) Start(ctx context.Context) error {
+	if _, err := w.Poll(ctx); err != nil {
+		return err
+	}
+	w.wg.Add(1)
+	go w.loop()
+	return nil
+}
+
+// Stop stops watching and ends all subscriptions.
+func (w *PaymentWatcher) Stop() {
+	close(w.quit)
+	w.wg.Wait()
+	w.scope.Close()
+}
+
+// Subscribe delivers every newly received payment on ch.
+// The channel should have ample buffer space to not stall the watcher.
+func (w *PaymentWatcher) Subscribe(ch chan<- PaymentEvent) event.Subscription {
+	return w.scope.Track(w.feed.Subscribe(ch))
+}
+
+// Wake makes the watcher poll right away and return to its shortest
+// poll interval. It should be called when a payment is expected.
+func (w *PaymentWatcher) Wake() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (w *PaymentWatcher) loop() {
+	defer w.wg.Done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-w.quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	pause := watchPollPause
+	for {
+		select {
+		case <-w.quit:
+			return
+		case <-w.wake:
+			pause = watchPollPause
+		case <-time.After(pause):
+		}
+		payments, err := w.Poll(ctx)
+		// Back off while the history is unchanged
+		if err != nil || len(payments) == 0 {
+			if pause *= 2; pause > watchMaxPollPause {
+				pause = watchMaxPollPause
+			}
+			continue
+		}
+		pause = watchPollPause
+		for _, payment := range payments {
+			w.feed.Send(payment)
+		}
+	}
+}
+
+// Poll returns the payments that were received since the last poll.
+// It must not be called concurrently with a started watcher.
+func (w *PaymentWatcher) Poll(ctx context.Context) ([]PaymentEvent, error) {
+	h, err := w.node.PaymentHistoryContext(ctx, w.token, w.partner)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		payments []PaymentEvent
+		lastTime = w.lastTime
+		lastIDs  = w.lastIDs
+	)
+	for _, entry := range *h {
+		if entry.Event != EventPaymentReceivedSuccess {
+			continue
+		}
+		// Skip payments we have already seen
+		if entry.LogTime < w.lastTime || (entry.LogTime == w.lastTime && w.lastIDs[entry.Identifier]) {
+			continue
+		}
+		payments = append(payments, entry)
+		if entry.LogTime > lastTime {
+			lastTime = entry.LogTime
+			lastIDs = make(map[PaymentID]bool)
+		}
+		if entry.LogTime == lastTime {
+			lastIDs[entry.Identifier] = true
+		}
+	}
+	w.lastTime, w.lastIDs = lastTime, lastIDs
+	return payments, nil
+}
@@ -0,0 +1,689 @@
+// Package raidentest provides in-memory stand-ins for raiden nodes.
+//
+// A Network holds the state of any number of fake nodes. Every node serves
+// the address, status, version, channels, payments, tokens and connections
+// endpoints of the raiden REST API on its own httptest.Server, and payments
+// are routed between the nodes of the network through their channels.
+package raidentest
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// APIPath is the path under which the nodes serve the raiden API.
+const APIPath = "/api/v1"
+
+// Version is the raiden version reported by the nodes.
+const Version = "1.1.1"
+
+// The settle and reveal timeout of channels that are opened without one.
+var (
+	defaultSettleTimeout = big.NewInt(500)
+	defaultRevealTimeout = big.NewInt(50)
+)
+
+// Network is a set of fake raiden nodes that can pay each other.
+type Network struct {
+	// SettleDelay is the time it takes for a closed channel to settle.
+	SettleDelay time.Duration
+
+	lock     sync.Mutex
+	nodes    map[common.Address]*Node
+	tokens   map[common.Address]bool
+	channels []*channel
+	nextID   uint64
+}
+
+// NewNetwork creates an empty network.
+func NewNetwork() *Network {
+	return &Network{
+		nodes:  make(map[common.Address]*Node),
+		tokens: make(map[common.Address]bool),
+		nextID: 1,
+	}
+}
+
+// AddToken registers a token network.
+func (n *Network) AddToken(token string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.tokens[common.HexToAddress(token)] = true
+}
+
+// NewNode creates a new node with the given address and starts serving its API.
+func (n *Network) NewNode(address string) *Node {
+	node := &Node{
+		Address:     common.HexToAddress(address),
+		network:     n,
+		status:      "ready",
+		connections: make(map[common.Address]*big.Int),
+	}
+	node.server = httptest.NewServer(node)
+
+	n.lock.Lock()
+	n.nodes[node.Address] = node
+	n.lock.Unlock()
+	return node
+}
+
+// Node returns the node of the network with the address, or nil if there is none.
+func (n *Network) Node(address string) *Node {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.nodes[common.HexToAddress(address)]
+}
+
+// OpenChannel opens a channel between the nodes a and b and deposits
+// into it. It is a shortcut for setting up the network in tests.
+func (n *Network) OpenChannel(token string, a, b *Node, depositA, depositB *big.Int) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.tokens[common.HexToAddress(token)] = true
+	ch := n.openChannel(common.HexToAddress(token), a.Address, b.Address, defaultSettleTimeout)
+	ch.deposit[0].Set(depositA)
+	ch.deposit[1].Set(depositB)
+}
+
+// Close stops all nodes of the network.
+func (n *Network) Close() {
+	n.lock.Lock()
+	nodes := make([]*Node, 0, len(n.nodes))
+	for _, node := range n.nodes {
+		nodes = append(nodes, node)
+	}
+	n.lock.Unlock()
+	for _, node := range nodes {
+		node.Close()
+	}
+}
+
+// Node is a fake raiden node.
+type Node struct {
+	Address common.Address
+
+	network *Network
+	server  *httptest.Server
+
+	// The following fields are guarded by the network lock
+	status       string
+	blocksToSync uint64
+	events       []paymentEvent
+	connections  map[common.Address]*big.Int // joined token networks and their funds
+}
+
+// URL returns the base url of the raiden API of the node.
+// Ex. http://127.0.0.1:34567/api/v1
+func (node *Node) URL() string {
+	return node.server.URL + APIPath
+}
+
+// Close stops serving the API of the node.
+func (node *Node) Close() {
+	node.server.Close()
+}
+
+// SetStatus sets the synchronization status reported by the node.
+func (node *Node) SetStatus(status string, blocksToSync uint64) {
+	n := node.network
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	node.status, node.blocksToSync = status, blocksToSync
+}
+
+// Balance returns the balance of the node in the channel with partner.
+func (node *Node) Balance(token, partner string) *big.Int {
+	n := node.network
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	ch := n.channel(common.HexToAddress(token), node.Address, common.HexToAddress(partner))
+	if ch == nil {
+		return new(big.Int)
+	}
+	return ch.balance(ch.index(node.Address))
+}
+
+// channel is a channel between two nodes of the network.
+type channel struct {
+	id            uint64
+	token         common.Address
+	participants  [2]common.Address
+	deposit       [2]*big.Int
+	withdraw      [2]*big.Int
+	sent          [2]*big.Int
+	settleTimeout *big.Int
+	state         string
+	closed        time.Time
+}
+
+// index returns the index of the participant in the channel.
+func (ch *channel) index(addr common.Address) int {
+	if ch.participants[0] == addr {
+		return 0
+	}
+	return 1
+}
+
+// balance returns the spendable balance of the participant with index i.
+func (ch *channel) balance(i int) *big.Int {
+	balance := new(big.Int).Sub(ch.deposit[i], ch.withdraw[i])
+	balance.Sub(balance, ch.sent[i])
+	return balance.Add(balance, ch.sent[1-i])
+}
+
+// openChannel creates a new channel. The lock must be held.
+func (n *Network) openChannel(token, a, b common.Address, settleTimeout *big.Int) *channel {
+	ch := &channel{
+		id:            n.nextID,
+		token:         token,
+		participants:  [2]common.Address{a, b},
+		deposit:       [2]*big.Int{new(big.Int), new(big.Int)},
+		withdraw:      [2]*big.Int{new(big.Int), new(big.Int)},
+		sent:          [2]*big.Int{new(big.Int), new(big.Int)},
+		settleTimeout: settleTimeout,
+		state:         "opened",
+	}
+	n.nextID++
+	n.channels = append(n.channels, ch)
+	return ch
+}
+
+// channel returns the unsettled channel between a and b. The lock must be held.
+func (n *Network) channel(token, a, b common.Address) *channel {
+	for _, ch := range n.channels {
+		if ch.token != token || n.state(ch) == "settled" {
+			continue
+		}
+		if (ch.participants[0] == a && ch.participants[1] == b) || (ch.participants[0] == b && ch.participants[1] == a) {
+			return ch
+		}
+	}
+	return nil
+}
+
+// state returns the current state of the channel. The lock must be held.
+func (n *Network) state(ch *channel) string {
+	if ch.state == "closed" && time.Since(ch.closed) >= n.SettleDelay {
+		ch.state = "settled"
+	}
+	return ch.state
+}
+
+// channelsOf returns the unsettled channels of the node. The lock must be held.
+func (n *Network) channelsOf(addr common.Address) []*channel {
+	var channels []*channel
+	for _, ch := range n.channels {
+		if n.state(ch) == "settled" {
+			continue
+		}
+		if ch.participants[0] == addr || ch.participants[1] == addr {
+			channels = append(channels, ch)
+		}
+	}
+	return channels
+}
+
+// route finds the shortest path of open channels from source to target that
+// can carry amount. The lock must be held.
+func (n *Network) route(token, source, target common.Address, amount *big.Int) []*channel {
+	type hop struct {
+		addr common.Address
+		path []*channel
+	}
+	visited := map[common.Address]bool{source: true}
+	queue := []hop{{addr: source}}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		for _, ch := range n.channelsOf(current.addr) {
+			if ch.token != token || ch.state != "opened" {
+				continue
+			}
+			i := ch.index(current.addr)
+			next := ch.participants[1-i]
+			if visited[next] || ch.balance(i).Cmp(amount) < 0 {
+				continue
+			}
+			path := append(append([]*channel{}, current.path...), ch)
+			if next == target {
+				return path
+			}
+			visited[next] = true
+			queue = append(queue, hop{addr: next, path: path})
+		}
+	}
+	return nil
+}
+
+// The wire format of the raiden API.
+
+// address marshals to a checksummed hex string like the raiden API does.
+type address common.Address
+
+func (a address) MarshalJSON() ([]byte, error) {
+	return json.Marshal(common.Address(a).Hex())
+}
+
+type channelJSON struct {
+	TokenAddress        address `json:"token_address"`
+	PartnerAddress      address `json:"partner_address"`
+	SettleTimeout       string  `json:"settle_timeout"`
+	RevealTimeout       string  `json:"reveal_timeout"`
+	Balance             string  `json:"balance"`
+	TokenNetworkAddress address `json:"token_network_address"`
+	TotalDeposit        string  `json:"total_deposit"`
+	State               string  `json:"state"`
+	ChannelIdentifier   string  `json:"channel_identifier"`
+	TotalWithdraw       string  `json:"total_withdraw"`
+}
+
+type paymentEvent struct {
+	Event        string   `json:"event"`
+	Identifier   string   `json:"identifier"`
+	LogTime      string   `json:"log_time"`
+	Amount       string   `json:"amount"`
+	TokenAddress address  `json:"token_address"`
+	Initiator    *address `json:"initiator,omitempty"`
+	Target       *address `json:"target,omitempty"`
+}
+
+// amount decodes amounts, which the raiden API accepts as strings and numbers.
+type amount struct{ big.Int }
+
+func (a *amount) UnmarshalJSON(input []byte) error {
+	s := strings.Trim(string(input), `"`)
+	if _, ok := a.SetString(s, 10); !ok || a.Sign() < 0 {
+		return fmt.Errorf("invalid amount %q", s)
+	}
+	return nil
+}
+
+// channelJSON returns the channel from the perspective of addr. The lock must be held.
+func (n *Network) channelJSON(ch *channel, addr common.Address) channelJSON {
+	i := ch.index(addr)
+	return channelJSON{
+		TokenAddress:        address(ch.token),
+		PartnerAddress:      address(ch.participants[1-i]),
+		SettleTimeout:       ch.settleTimeout.String(),
+		RevealTimeout:       defaultRevealTimeout.String(),
+		Balance:             ch.balance(i).String(),
+		TokenNetworkAddress: address(ch.token),
+		TotalDeposit:        ch.deposit[i].String(),
+		State:               n.state(ch),
+		ChannelIdentifier:   fmt.Sprint(ch.id),
+		TotalWithdraw:       ch.withdraw[i].String(),
+	}
+}
+
+type apiError struct {
+	status  int
+	message string
+}
+
+func errorf(status int, format string, args ...interface{}) *apiError {
+	return &apiError{status: status, message: fmt.Sprintf(format, args...)}
+}
+
+// ServeHTTP implements the raiden API.
+func (node *Node) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, APIPath+"/") {
+		http.NotFound(w, r)
+		return
+	}
+	path := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, APIPath), "/"), "/")
+
+	n := node.network
+	n.lock.Lock()
+	status, result, err := node.handle(r, path)
+	n.lock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(err.status)
+		json.NewEncoder(w).Encode(map[string]string{"errors": err.message})
+		return
+	}
+	w.WriteHeader(status)
+	if result != nil {
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+// handle dispatches the request to the endpoint. The lock must be held.
+func (node *Node) handle(r *http.Request, path []string) (int, interface{}, *apiError) {
+	endpoint := fmt.Sprintf("%v %v/%v", r.Method, path[0], len(path)-1)
+	switch endpoint {
+	case "GET address/0":
+		return http.StatusOK, map[string]address{"our_address": address(node.Address)}, nil
+	case "GET status/0":
+		status := map[string]string{"status": node.status}
+		if node.status == "syncing" {
+			status["blocks_to_sync"] = fmt.Sprint(node.blocksToSync)
+		}
+		return http.StatusOK, status, nil
+	case "GET version/0":
+		return http.StatusOK, map[string]string{"version": Version}, nil
+	case "GET tokens/0":
+		return http.StatusOK, node.tokens(), nil
+	case "GET tokens/2":
+		if path[2] != "partners" {
+			break
+		}
+		return node.partners(common.HexToAddress(path[1]))
+	case "GET channels/0":
+		return node.listChannels(nil)
+	case "GET channels/1":
+		token := common.HexToAddress(path[1])
+		return node.listChannels(&token)
+	case "GET channels/2":
+		return node.queryChannel(common.HexToAddress(path[1]), common.HexToAddress(path[2]))
+	case "PUT channels/0":
+		return node.openChannel(r)
+	case "PATCH channels/2":
+		return node.patchChannel(r, common.HexToAddress(path[1]), common.HexToAddress(path[2]))
+	case "GET payments/1":
+		return node.paymentHistory(common.HexToAddress(path[1]), nil)
+	case "GET payments/2":
+		partner := common.HexToAddress(path[2])
+		return node.paymentHistory(common.HexToAddress(path[1]), &partner)
+	case "POST payments/2":
+		return node.pay(r, common.HexToAddress(path[1]), common.HexToAddress(path[2]))
+	case "GET connections/0":
+		return node.listConnections()
+	case "PUT connections/1":
+		return node.joinNetwork(r, common.HexToAddress(path[1]))
+	case "DELETE connections/1":
+		return node.leaveNetwork(common.HexToAddress(path[1]))
+	}
+	return 0, nil, errorf(http.StatusNotFound, "The requested URL was not found on the server.")
+}
+
+func (node *Node) tokens() []address {
+	tokens := []address{}
+	for token := range node.network.tokens {
+		tokens = append(tokens, address(token))
+	}
+	return tokens
+}
+
+func (node *Node) partners(token common.Address) (int, interface{}, *apiError) {
+	type partner struct {
+		PartnerAddress address `json:"partner_address"`
+		Channel        string  `json:"channel"`
+	}
+	partners := []partner{}
+	for _, ch := range node.network.channelsOf(node.Address) {
+		if ch.token != token {
+			continue
+		}
+		other := ch.participants[1-ch.index(node.Address)]
+		partners = append(partners, partner{
+			PartnerAddress: address(other),
+			Channel:        fmt.Sprintf("%v/channels/%v/%v", APIPath, token.Hex(), other.Hex()),
+		})
+	}
+	return http.StatusOK, partners, nil
+}
+
+func (node *Node) listChannels(token *common.Address) (int, interface{}, *apiError) {
+	n := node.network
+	channels := []channelJSON{}
+	for _, ch := range n.channelsOf(node.Address) {
+		if token == nil || ch.token == *token {
+			channels = append(channels, n.channelJSON(ch, node.Address))
+		}
+	}
+	return http.StatusOK, channels, nil
+}
+
+func (node *Node) queryChannel(token, partner common.Address) (int, interface{}, *apiError) {
+	n := node.network
+	ch := n.channel(token, node.Address, partner)
+	if ch == nil {
+		return 0, nil, errorf(http.StatusNotFound, "Channel with partner '%v' for token '%v' could not be found.", partner.Hex(), token.Hex())
+	}
+	return http.StatusOK, n.channelJSON(ch, node.Address), nil
+}
+
+func (node *Node) openChannel(r *http.Request) (int, interface{}, *apiError) {
+	var req struct {
+		PartnerAddress common.Address `json:"partner_address"`
+		TokenAddress   common.Address `json:"token_address"`
+		TotalDeposit   *amount        `json:"total_deposit"`
+		SettleTimeout  *amount        `json:"settle_timeout"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return 0, nil, errorf(http.StatusBadRequest, "%v", err)
+	}
+	n := node.network
+	if !n.tokens[req.TokenAddress] {
+		return 0, nil, errorf(http.StatusConflict, "Token network for token %v does not exist", req.TokenAddress.Hex())
+	}
+	if n.channel(req.TokenAddress, node.Address, req.PartnerAddress) != nil {
+		return 0, nil, errorf(http.StatusConflict, "Channel with given partner address already exists")
+	}
+	settleTimeout := defaultSettleTimeout
+	if req.SettleTimeout != nil {
+		settleTimeout = &req.SettleTimeout.Int
+	}
+	ch := n.openChannel(req.TokenAddress, node.Address, req.PartnerAddress, settleTimeout)
+	if req.TotalDeposit != nil {
+		ch.deposit[0].Set(&req.TotalDeposit.Int)
+	}
+	return http.StatusCreated, n.channelJSON(ch, node.Address), nil
+}
+
+func (node *Node) patchChannel(r *http.Request, token, partner common.Address) (int, interface{}, *apiError) {
+	var req struct {
+		TotalDeposit  *amount `json:"total_deposit"`
+		TotalWithdraw *amount `json:"total_withdraw"`
+		State         string  `json:"state"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return 0, nil, errorf(http.StatusBadRequest, "%v", err)
+	}
+	n := node.network
+	ch := n.channel(token, node.Address, partner)
+	if ch == nil {
+		return 0, nil, errorf(http.StatusNotFound, "Requested channel for token %v and partner %v not found", token.Hex(), partner.Hex())
+	}
+	if n.state(ch) != "opened" {
+		return 0, nil, errorf(http.StatusConflict, "Attempted to change a channel that is not open")
+	}
+	i := ch.index(node.Address)
+	switch {
+	case req.TotalDeposit != nil:
+		if req.TotalDeposit.Cmp(ch.deposit[i]) <= 0 {
+			return 0, nil, errorf(http.StatusConflict, "The new total deposit must be higher than the previous total deposit")
+		}
+		ch.deposit[i].Set(&req.TotalDeposit.Int)
+	case req.TotalWithdraw != nil:
+		increase := new(big.Int).Sub(&req.TotalWithdraw.Int, ch.withdraw[i])
+		if increase.Sign() <= 0 {
+			return 0, nil, errorf(http.StatusConflict, "The new total withdraw must be higher than the previous total withdraw")
+		}
+		if increase.Cmp(ch.balance(i)) > 0 {
+			return 0, nil, errorf(http.StatusPaymentRequired, "The withdraw of %v is bigger than the current balance", increase)
+		}
+		ch.withdraw[i].Set(&req.TotalWithdraw.Int)
+	case req.State == "closed":
+		ch.state = "closed"
+		ch.closed = time.Now()
+		closed := n.channelJSON(ch, node.Address)
+		closed.State = "closed"
+		return http.StatusOK, closed, nil
+	default:
+		return 0, nil, errorf(http.StatusBadRequest, "Nothing to update")
+	}
+	return http.StatusOK, n.channelJSON(ch, node.Address), nil
+}
+
+func (node *Node) paymentHistory(token common.Address, partner *common.Address) (int, interface{}, *apiError) {
+	events := []paymentEvent{}
+	for _, ev := range node.events {
+		if ev.TokenAddress != address(token) {
+			continue
+		}
+		if partner != nil && (ev.Initiator == nil || *ev.Initiator != address(*partner)) && (ev.Target == nil || *ev.Target != address(*partner)) {
+			continue
+		}
+		events = append(events, ev)
+	}
+	return http.StatusOK, events, nil
+}
+
+func (node *Node) pay(r *http.Request, token, target common.Address) (int, interface{}, *apiError) {
+	var req struct {
+		Amount     *amount `json:"amount"`
+		Identifier *amount `json:"identifier"`
+		Secret     string  `json:"secret"`
+		SecretHash string  `json:"secret_hash"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return 0, nil, errorf(http.StatusBadRequest, "%v", err)
+	}
+	if req.Amount == nil || req.Amount.Sign() <= 0 {
+		return 0, nil, errorf(http.StatusBadRequest, "amount: Must be greater than 0")
+	}
+	n := node.network
+	if !n.tokens[token] {
+		return 0, nil, errorf(http.StatusNotFound, "Token %v not found", token.Hex())
+	}
+	id := randomID()
+	if req.Identifier != nil {
+		id = req.Identifier.Uint64()
+	}
+	secret := req.Secret
+	if secret == "" {
+		var buf [32]byte
+		rand.Read(buf[:])
+		secret = hexutil.Encode(buf[:])
+	}
+	secretHash := req.SecretHash
+	if secretHash == "" {
+		hash := sha256.Sum256(common.FromHex(secret))
+		secretHash = hexutil.Encode(hash[:])
+	}
+	path := n.route(token, node.Address, target, &req.Amount.Int)
+	if path == nil {
+		return 0, nil, errorf(http.StatusPaymentRequired, "Payment couldn't be completed because: there is no route available")
+	}
+	// Transfer the amount along the route
+	hop := node.Address
+	for _, ch := range path {
+		i := ch.index(hop)
+		ch.sent[i].Add(ch.sent[i], &req.Amount.Int)
+		hop = ch.participants[1-i]
+	}
+	logTime := time.Now().UTC().Format("2006-01-02T15:04:05.000000")
+	initiator, receiver := address(node.Address), address(target)
+	node.events = append(node.events, paymentEvent{
+		Event:        "EventPaymentSentSuccess",
+		Identifier:   fmt.Sprint(id),
+		LogTime:      logTime,
+		Amount:       req.Amount.String(),
+		TokenAddress: address(token),
+		Target:       &receiver,
+	})
+	if other := n.nodes[target]; other != nil {
+		other.events = append(other.events, paymentEvent{
+			Event:        "EventPaymentReceivedSuccess",
+			Identifier:   fmt.Sprint(id),
+			LogTime:      logTime,
+			Amount:       req.Amount.String(),
+			TokenAddress: address(token),
+			Initiator:    &initiator,
+		})
+	}
+	return http.StatusOK, map[string]interface{}{
+		"initiator_address": address(node.Address),
+		"target_address":    address(target),
+		"token_address":     address(token),
+		"amount":            req.Amount.String(),
+		"identifier":        fmt.Sprint(id),
+		"secret":            secret,
+		"secret_hash":       secretHash,
+	}, nil
+}
+
+func (node *Node) listConnections() (int, interface{}, *apiError) {
+	type connection struct {
+		Funds       string `json:"funds"`
+		SumDeposits string `json:"sum_deposits"`
+		Channels    string `json:"channels"`
+	}
+	n := node.network
+	connections := make(map[string]connection)
+	for token, funds := range node.connections {
+		deposits, channels := new(big.Int), 0
+		for _, ch := range n.channelsOf(node.Address) {
+			if ch.token == token && n.state(ch) == "opened" {
+				deposits.Add(deposits, ch.deposit[ch.index(node.Address)])
+				channels++
+			}
+		}
+		connections[token.Hex()] = connection{
+			Funds:       funds.String(),
+			SumDeposits: deposits.String(),
+			Channels:    fmt.Sprint(channels),
+		}
+	}
+	return http.StatusOK, connections, nil
+}
+
+func (node *Node) joinNetwork(r *http.Request, token common.Address) (int, interface{}, *apiError) {
+	var req struct {
+		Funds *amount `json:"funds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return 0, nil, errorf(http.StatusBadRequest, "%v", err)
+	}
+	if req.Funds == nil || req.Funds.Sign() <= 0 {
+		return 0, nil, errorf(http.StatusBadRequest, "funds: Must be greater than 0")
+	}
+	node.network.tokens[token] = true
+	node.connections[token] = new(big.Int).Set(&req.Funds.Int)
+	return http.StatusNoContent, nil, nil
+}
+
+func (node *Node) leaveNetwork(token common.Address) (int, interface{}, *apiError) {
+	n := node.network
+	if _, ok := node.connections[token]; !ok {
+		return 0, nil, errorf(http.StatusConflict, "Not connected to the token network %v", token.Hex())
+	}
+	delete(node.connections, token)
+	closed := []channelJSON{}
+	for _, ch := range n.channelsOf(node.Address) {
+		if ch.token == token && n.state(ch) == "opened" {
+			ch.state = "closed"
+			ch.closed = time.Now()
+			channel := n.channelJSON(ch, node.Address)
+			channel.State = "closed"
+			closed = append(closed, channel)
+		}
+	}
+	return http.StatusOK, closed, nil
+}
+
+// randomID returns a random non-zero payment identifier.
+func randomID() uint64 {
+	var buf [8]byte
+	for {
+		rand.Read(buf[:])
+		if id := binary.BigEndian.Uint64(buf[:]); id != 0 {
+			return id
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"github.com/MariusVanDerWijden/ShareMyRPC/pricing"
+	"github.com/MariusVanDerWijden/ShareMyRPC/raiden"
+)
+
+// Option configures a server created by NewServer.
+type Option func(*config)
+
+type config struct {
+	address    string // expected address of the raiden node, empty for any
+	raidenOpts []raiden.Option
+	schedule   *pricing.Schedule
+	trusted    bool           // payer addresses passed by clients are believed
+	limit      *raiden.Amount // postpaid requests are served if set
+	debtors    []string       // addresses served on credit, nil for all customers
+}
+
+func newConfig(opts []Option) *config {
+	cfg := &config{
+		schedule: pricing.DefaultSchedule(),
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	return cfg
+}
+
+// WithAddress makes the server fail if the raiden node
+// runs with another account than address.
+func WithAddress(address string) Option {
+	return func(cfg *config) {
+		cfg.address = address
+	}
+}
+
+// WithRaidenOptions configures the connector to the raiden node.
+func WithRaidenOptions(opts ...raiden.Option) Option {
+	return func(cfg *config) {
+		cfg.raidenOpts = append(cfg.raidenOpts, opts...)
+	}
+}
+
+// WithSchedule sets the price schedule the server demands payment by.
+func WithSchedule(schedule *pricing.Schedule) Option {
+	return func(cfg *config) {
+		cfg.schedule = schedule
+	}
+}
+
+// WithTrustedPayers makes the server believe the raiden address clients
+// pass in the PayerHeader or PayerParam, and pay their requests from the
+// payments and credit of that address. The address is not authenticated,
+// so any client can spend the payments of any address it knows. Only use
+// it if the proxy is reachable by trusted clients alone. Websocket
+// connections and prepaid requests can only be paid this way.
+func WithTrustedPayers() Option {
+	return func(cfg *config) {
+		cfg.trusted = true
+	}
+}
+
+// WithCreditLimit makes the server serve requests of clients that pass
+// their raiden address in the PayerHeader before they are paid for, as long
+// as the unpaid balance of the address stays within limit. Since the debt is
+// attributed to the address the client claims, the limit needs
+// WithTrustedPayers. Payments from the
+// address settle its unpaid balance first. Only addresses with an open
+// channel with the node, and only the peer of the server if it has one, are
+// served on credit, see also WithDebtors.
+func WithCreditLimit(limit *raiden.Amount) Option {
+	return func(cfg *config) {
+		cfg.limit = limit
+	}
+}
+
+// WithDebtors restricts the addresses that are served on credit to the
+// given raiden addresses.
+func WithDebtors(addresses ...string) Option {
+	return func(cfg *config) {
+		cfg.debtors = append(cfg.debtors, addresses...)
+	}
+}
@@ -0,0 +1,397 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/MariusVanDerWijden/ShareMyRPC/pricing"
+	"github.com/MariusVanDerWijden/ShareMyRPC/raiden"
+	"github.com/gorilla/websocket"
+)
+
+var (
+	paymentTimeout = 10 * time.Second
+	maxRequestSize = int64(5 * 1024 * 1024)
+)
+
+// PricesMethod is the free JSON-RPC method that returns the prices of the server.
+const PricesMethod = "sharemyrpc_prices"
+
+// PricesPath is the HTTP path under which GET requests return the prices of the server.
+const PricesPath = "/prices"
+
+// PaymentIDHeader is the HTTP header in which clients pass the
+// identifier of the raiden payment for their request.
+const PaymentIDHeader = "X-Payment-Identifier"
+
+// PayerHeader is the HTTP header in which clients pass their raiden
+// address. If the server trusts its clients, see WithTrustedPayers, their
+// requests are paid from the payments and credit of that address, so
+// clients in prepaid mode need not pay per request. Otherwise the header
+// is ignored and requests are only paid by the payment whose identifier
+// is passed in the PaymentIDHeader.
+const PayerHeader = "X-Raiden-Address"
+
+// PayerParam is the query parameter in which websocket clients, whose
+// handshake headers can often not be set, pass their raiden address
+// instead of the PayerHeader.
+const PayerParam = "payer"
+
+// RefundHeader is the HTTP response header in which the proxy tells clients
+// the amount it refunded for paid requests the node failed to serve. The
+// amount is credited to the payer of the request and spent on its next
+// requests. Requests over websocket connections are refunded as well, but
+// the refund is only visible in the credit of the payer.
+const RefundHeader = "X-Raiden-Refund"
+
+// PaymentMissingCode is the JSON-RPC error code of requests that were
+// refused because their payment was not received.
+const PaymentMissingCode = -32001
+
+// CreditMethod is the free JSON-RPC method that returns the credit of the
+// raiden address passed as its only parameter.
+const CreditMethod = "sharemyrpc_credit"
+
+const (
+	errcodeInvalidRequest = -32600
+	errcodeInvalidParams  = -32602
+	errcodeInternal       = -32603
+	errcodePaymentMissing = PaymentMissingCode
+	errcodeUpstream       = -32002
+
+	// Range of the error codes of the node itself
+	errcodeServerMax = -32000
+	errcodeServerMin = -32099
+)
+
+// Proxy is a http.Handler that serves JSON-RPC requests to paying customers.
+// Every request is only forwarded to the backing node after the
+// payment for it was received by the server. Requests the node fails
+// to serve are refunded, see RefundHeader.
+type Proxy struct {
+	server  *Server
+	nodeURL string
+	wsURL   string // websocket endpoint of the node, empty if not served
+	client  *http.Client
+}
+
+// ProxyOption configures a proxy created by NewProxy.
+type ProxyOption func(*Proxy)
+
+// WithNodeWebSocket makes the proxy serve websocket connections by
+// forwarding them to the websocket endpoint of the node at url.
+// Ex. ws://127.0.0.1:8546
+func WithNodeWebSocket(url string) ProxyOption {
+	return func(p *Proxy) {
+		p.wsURL = url
+	}
+}
+
+// NewProxy creates a new proxy that forwards paid requests to the
+// node at nodeURL. Ex. http://127.0.0.1:8545
+func NewProxy(server *Server, nodeURL string, opts ...ProxyOption) *Proxy {
+	p := &Proxy{
+		server:  server,
+		nodeURL: nodeURL,
+		client:  http.DefaultClient,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+type jsonrpcMessage struct {
+	Version string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *jsonError      `json:"error,omitempty"`
+}
+
+type jsonError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if websocket.IsWebSocketUpgrade(r) {
+		p.serveWebSocket(w, r)
+		return
+	}
+	if r.Method == http.MethodGet && r.URL.Path == PricesPath {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(p.server.Offer())
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxRequestSize))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, nil, errcodeInvalidRequest, err.Error())
+		return
+	}
+	msgs, err := parseMessages(body)
+	if err == nil {
+		err = checkIDs(msgs)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, nil, errcodeInvalidRequest, err.Error())
+		return
+	}
+	// Answer price and credit requests ourselves
+	if len(msgs) == 1 {
+		if result, jsonErr, ok := p.local(msgs[0]); ok {
+			if jsonErr != nil {
+				writeError(w, http.StatusBadRequest, msgs[0].ID, jsonErr.Code, jsonErr.Message)
+			} else {
+				writeResult(w, msgs[0].ID, result)
+			}
+			return
+		}
+	}
+	cost := p.cost(msgs)
+	// Tie the payment to the request if the client told us its identifier,
+	// or pay from the credit of the client if it told us its address
+	payer, match := p.payerOf(r), p.payerMatch(r)
+	if header := r.Header.Get(PaymentIDHeader); header != "" {
+		var id raiden.PaymentID
+		if err := id.UnmarshalJSON([]byte(header)); err != nil {
+			writeError(w, http.StatusBadRequest, msgs[0].ID, errcodeInvalidRequest, err.Error())
+			return
+		}
+		if id == 0 {
+			writeError(w, http.StatusBadRequest, msgs[0].ID, errcodeInvalidRequest, "missing payment identifier")
+			return
+		}
+		payer, match = "", paymentWithID(id)
+	}
+	// Failed requests are refunded to whoever was charged for them
+	charged := payer
+	if cost.Int().Sign() > 0 {
+		var ok bool
+		if charged, ok = p.server.charge(r.Context(), paymentTimeout, payer, match, cost); !ok {
+			writeError(w, http.StatusPaymentRequired, msgs[0].ID, errcodePaymentMissing, fmt.Sprintf("payment of %v not received", cost))
+			return
+		}
+	}
+	status, resp, err := p.forward(r.Context(), body)
+	if err != nil {
+		p.refund(w, charged, cost)
+		writeError(w, http.StatusBadGateway, msgs[0].ID, errcodeUpstream, err.Error())
+		return
+	}
+	p.refund(w, charged, p.failedCost(msgs, status, resp))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(resp)
+}
+
+// refund credits amount to payer, or to requests without payer if
+// payer is empty, and tells the client about it.
+func (p *Proxy) refund(w http.ResponseWriter, payer string, amount *raiden.Amount) {
+	if amount.Int().Sign() == 0 {
+		return
+	}
+	p.server.refund(payer, amount.Int())
+	w.Header().Set(RefundHeader, amount.String())
+}
+
+// failedCost returns the price of the requests the node failed to serve:
+// all of them if the node did not answer with status 200, otherwise those
+// answered with an error of the node itself or not answered at all.
+// Requests the node rejected, for example for invalid parameters or a
+// reverted call, are not refunded.
+func (p *Proxy) failedCost(msgs []*jsonrpcMessage, status int, resp []byte) *raiden.Amount {
+	if status != http.StatusOK {
+		return p.cost(msgs)
+	}
+	answers, err := parseMessages(resp)
+	if err != nil {
+		return p.cost(msgs)
+	}
+	failed := make(map[string]bool)
+	for _, answer := range answers {
+		failed[string(answer.ID)] = nodeFailed(answer)
+	}
+	var refunded []*jsonrpcMessage
+	for _, msg := range msgs {
+		// Notifications are not answered
+		if msg.ID == nil {
+			continue
+		}
+		if fail, ok := failed[string(msg.ID)]; fail || !ok {
+			refunded = append(refunded, msg)
+		}
+	}
+	return p.cost(refunded)
+}
+
+// nodeFailed returns true if the answer is an internal error or a server
+// error of the node, which are not caused by the request.
+func nodeFailed(answer *jsonrpcMessage) bool {
+	if answer.Error == nil {
+		return false
+	}
+	code := answer.Error.Code
+	return code == errcodeInternal || (code <= errcodeServerMax && code >= errcodeServerMin)
+}
+
+// checkIDs returns an error if requests of a batch share an identifier,
+// since their answers could not be told apart.
+func checkIDs(msgs []*jsonrpcMessage) error {
+	seen := make(map[string]bool)
+	for _, msg := range msgs {
+		if msg.ID == nil {
+			continue
+		}
+		if seen[string(msg.ID)] {
+			return fmt.Errorf("duplicate request id %s", msg.ID)
+		}
+		seen[string(msg.ID)] = true
+	}
+	return nil
+}
+
+// local answers the free requests about prices and credit. It returns
+// false if the request has to be forwarded to the node.
+func (p *Proxy) local(msg *jsonrpcMessage) (interface{}, *jsonError, bool) {
+	switch msg.Method {
+	case PricesMethod:
+		return p.server.Offer(), nil, true
+	case CreditMethod:
+		var params []string
+		if err := json.Unmarshal(msg.Params, &params); err != nil || len(params) != 1 {
+			return nil, &jsonError{Code: errcodeInvalidParams, Message: "expected the address as only parameter"}, true
+		}
+		return p.server.Credit(params[0]), nil, true
+	}
+	return nil, nil, false
+}
+
+// cost returns the price of serving the messages.
+func (p *Proxy) cost(msgs []*jsonrpcMessage) *raiden.Amount {
+	methods := make([]string, len(msgs))
+	for i, msg := range msgs {
+		methods[i] = msg.Method
+		if msg.Method == subscribeMethod {
+			methods[i] = pricing.SubscriptionMethod(subscriptionKind(msg))
+		}
+	}
+	return p.server.schedule.Total(methods...)
+}
+
+// subscriptionKind returns the kind of subscription requested by an
+// eth_subscribe message, ex. "newHeads".
+func subscriptionKind(msg *jsonrpcMessage) string {
+	var params []json.RawMessage
+	if err := json.Unmarshal(msg.Params, &params); err != nil || len(params) == 0 {
+		return ""
+	}
+	var kind string
+	json.Unmarshal(params[0], &kind)
+	return kind
+}
+
+// payerMatch matches the payments of the payer of the request. Requests
+// without payer only match payments without initiator, so they can never
+// spend the credit of an address.
+func (p *Proxy) payerMatch(r *http.Request) func(*receivedPayment) bool {
+	return paymentsFrom(p.payerOf(r))
+}
+
+// payerOf returns the raiden address the request is paid from, taken from
+// the PayerHeader or the PayerParam, or the empty string if there is none
+// or the server does not trust its clients.
+func (p *Proxy) payerOf(r *http.Request) string {
+	if !p.server.trusted {
+		return ""
+	}
+	if payer := r.Header.Get(PayerHeader); payer != "" {
+		return payer
+	}
+	return r.URL.Query().Get(PayerParam)
+}
+
+// forward sends the request to the backing node and returns the response.
+func (p *Proxy) forward(ctx context.Context, body []byte) (int, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.nodeURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+	return resp.StatusCode, data, nil
+}
+
+// parseMessages parses a single JSON-RPC request or a batch of requests.
+func parseMessages(body []byte) ([]*jsonrpcMessage, error) {
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		var msgs []*jsonrpcMessage
+		if err := json.Unmarshal(body, &msgs); err != nil {
+			return nil, err
+		}
+		if len(msgs) == 0 {
+			return nil, fmt.Errorf("empty batch")
+		}
+		return msgs, nil
+	}
+	msg := new(jsonrpcMessage)
+	if err := json.Unmarshal(body, msg); err != nil {
+		return nil, err
+	}
+	return []*jsonrpcMessage{msg}, nil
+}
+
+func writeResult(w http.ResponseWriter, id json.RawMessage, result interface{}) {
+	msg, err := resultMessage(id, result)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, id, errcodeInternal, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(msg)
+}
+
+func writeError(w http.ResponseWriter, status int, id json.RawMessage, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorMessage(id, code, message))
+}
+
+func resultMessage(id json.RawMessage, result interface{}) (*jsonrpcMessage, error) {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonrpcMessage{Version: "2.0", ID: id, Result: data}, nil
+}
+
+func errorMessage(id json.RawMessage, code int, message string) *jsonrpcMessage {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	return &jsonrpcMessage{
+		Version: "2.0",
+		ID:      id,
+		Error:   &jsonError{Code: code, Message: message},
+	}
+}
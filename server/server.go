@@ -2,71 +2,394 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math/big"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/MariusVanDerWijden/ShareMyRPC/pricing"
 	"github.com/MariusVanDerWijden/ShareMyRPC/raiden"
+	"github.com/ethereum/go-ethereum/event"
 )
 
-var pollPause = 100 * time.Millisecond
+var (
+	maxDebtors      = 1024             // addresses served on credit at the same time
+	customerRefresh = 10 * time.Second // how long the list of customers is cached
+)
 
 type Server struct {
-	node    *raiden.Raiden
-	history *raiden.PaymentHistory
-	token   string
-	peer    string
+	node     *raiden.Raiden
+	watcher  *raiden.PaymentWatcher
+	sub      event.Subscription
+	token    string
+	peer     string
+	address  string // raiden address of the server
+	schedule *pricing.Schedule
+	trusted  bool            // payer addresses passed by clients are believed
+	limit    *big.Int        // credit limit of postpaid payers, nil if none
+	debtors  map[string]bool // lower case addresses served on credit, nil for all customers
+
+	customerLock sync.Mutex
+	customers    map[string]bool // lower case addresses of the customers
+	customersAt  time.Time       // when the customers were listed
+
+	lock     sync.Mutex
+	received []*receivedPayment  // payments with unspent value, oldest first
+	debts    map[string]*big.Int // unpaid balances by lower case payer address
+	payments int                 // number of raiden payments received
+	notify   chan struct{}       // closed when a new payment was received
 }
 
-func NewServer(url, token, peer string) (*Server, error) {
-	node := raiden.NewRaiden(url)
-	h, err := node.PaymentHistory(token, peer)
+// receivedPayment is a payment whose value was not yet fully spent on requests.
+// Refunds for failed requests are recorded as payments without identifier.
+type receivedPayment struct {
+	id        raiden.PaymentID
+	initiator string // raiden address of the payer
+	value     *big.Int
+	refund    bool // credited for failed requests, only spent by the initiator
+}
+
+// NewServer creates a new server that accepts payments from peer in the token network.
+// If peer is empty, payments from all partners are accepted.
+// It fails if the raiden node at url is not ready to receive payments.
+func NewServer(url, token, peer string, opts ...Option) (*Server, error) {
+	cfg := newConfig(opts)
+	if cfg.limit != nil && !cfg.trusted {
+		return nil, errors.New("credit limit needs trusted payers")
+	}
+	node := raiden.NewRaiden(url, cfg.raidenOpts...)
+	if err := node.CheckReady(context.Background(), cfg.address); err != nil {
+		return nil, err
+	}
+	address, err := node.Address()
 	if err != nil {
+		return nil, err
+	}
+	watcher := raiden.NewPaymentWatcher(node, token, peer)
+	if err := watcher.Start(context.Background()); err != nil {
 		fmt.Printf("could not retrieve payment history")
 		return nil, err
 	}
-	return &Server{
-		node:    node,
-		token:   token,
-		peer:    peer,
-		history: h,
-	}, nil
+	s := &Server{
+		node:     node,
+		watcher:  watcher,
+		token:    token,
+		peer:     peer,
+		address:  address,
+		schedule: cfg.schedule,
+		trusted:  cfg.trusted,
+		debts:    make(map[string]*big.Int),
+		notify:   make(chan struct{}),
+	}
+	if cfg.limit != nil {
+		s.limit = new(big.Int).Set(cfg.limit.Int())
+	}
+	if cfg.debtors != nil {
+		s.debtors = make(map[string]bool)
+		for _, debtor := range cfg.debtors {
+			s.debtors[strings.ToLower(debtor)] = true
+		}
+	}
+	payments := make(chan raiden.PaymentEvent, 128)
+	s.sub = watcher.Subscribe(payments)
+	go s.loop(payments)
+	return s, nil
+}
+
+// Close stops watching for payments.
+func (s *Server) Close() {
+	s.watcher.Stop()
+}
+
+// loop records the received payments until the subscription ends.
+func (s *Server) loop(payments chan raiden.PaymentEvent) {
+	for {
+		select {
+		case payment := <-payments:
+			s.addPayment(payment)
+		case <-s.sub.Err():
+			return
+		}
+	}
+}
+
+func (s *Server) addPayment(payment raiden.PaymentEvent) {
+	if payment.Amount == nil {
+		return
+	}
+	fmt.Printf("Received payment %v with value %v\n", payment.Identifier, payment.Amount)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.payments++
+	s.receive(&receivedPayment{
+		id:        payment.Identifier,
+		initiator: payment.Initiator,
+		value:     new(big.Int).Set(payment.Amount.Int()),
+	})
+}
+
+// refund credits amount to the raiden address payer for requests the node
+// failed to serve after they were paid for.
+func (s *Server) refund(payer string, amount *big.Int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.receive(&receivedPayment{initiator: payer, value: new(big.Int).Set(amount), refund: true})
+}
+
+// receive adds the payment to the credit of its initiator, after settling
+// the unpaid balance of the initiator. The lock must be held.
+func (s *Server) receive(payment *receivedPayment) {
+	payer := strings.ToLower(payment.initiator)
+	if debt := s.debts[payer]; debt != nil {
+		if debt.Cmp(payment.value) > 0 {
+			debt.Sub(debt, payment.value)
+			payment.value.SetInt64(0)
+		} else {
+			payment.value.Sub(payment.value, debt)
+			delete(s.debts, payer)
+		}
+	}
+	if payment.value.Sign() > 0 {
+		s.received = append(s.received, payment)
+	}
+	close(s.notify)
+	s.notify = make(chan struct{})
+}
+
+// Offer returns the prices of the server.
+func (s *Server) Offer() *pricing.Offer {
+	return &pricing.Offer{
+		Schedule: s.schedule,
+		Token:    s.token,
+		Address:  s.address,
+		Version:  s.schedule.Version,
+	}
+}
+
+// Customers returns the addresses of all partners that have an open channel
+// with the node in the token network of the server.
+func (s *Server) Customers(ctx context.Context) ([]string, error) {
+	channels, err := s.node.ListChannelsForTokenContext(ctx, s.token)
+	if err != nil {
+		return nil, err
+	}
+	var customers []string
+	for _, channel := range channels {
+		if channel.State.IsOpen() {
+			customers = append(customers, channel.PartnerAddress)
+		}
+	}
+	return customers, nil
 }
 
 // PaymentReceived returns true if a payment was received
-// within the given timeout.
+// within the given timeout. The payment is not spent.
 func (s *Server) PaymentReceived(ctx context.Context, maxTimeout time.Duration) bool {
-	start := time.Now()
-	for {
-		if s.pollHistory() {
+	timeout := time.NewTimer(maxTimeout)
+	defer timeout.Stop()
+	s.lock.Lock()
+	count := s.payments
+	for s.payments == count {
+		notify := s.notify
+		s.lock.Unlock()
+		s.watcher.Wake()
+		select {
+		case <-notify:
+		case <-timeout.C:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+		s.lock.Lock()
+	}
+	s.lock.Unlock()
+	return true
+}
+
+// Credit returns the unspent value of the payments received from the
+// raiden address payer and of the refunds for its failed requests. Clients
+// in prepaid mode pay for their requests from this credit.
+func (s *Server) Credit(payer string) *raiden.Amount {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return raiden.NewAmount(s.available(paymentsFrom(payer)))
+}
+
+// Debt returns the value of the requests that were served to the raiden
+// address payer on credit and not paid for yet.
+func (s *Server) Debt(payer string) *raiden.Amount {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	debt := new(big.Int)
+	if d := s.debts[strings.ToLower(payer)]; d != nil {
+		debt.Set(d)
+	}
+	return raiden.NewAmount(debt)
+}
+
+// paymentWithID matches the payment with the identifier. Refunds have no
+// identifier and are never matched.
+func paymentWithID(id raiden.PaymentID) func(*receivedPayment) bool {
+	return func(payment *receivedPayment) bool {
+		return payment.id == id && !payment.refund
+	}
+}
+
+// paymentsFrom matches the payments made by the raiden address payer.
+func paymentsFrom(payer string) func(*receivedPayment) bool {
+	return func(payment *receivedPayment) bool {
+		return strings.EqualFold(payment.initiator, payer)
+	}
+}
+
+// charge waits until payments worth at least amount were received within
+// the given timeout. Only the payments matched by match are accepted. The
+// amount is deducted from the received value, so every payment can only be
+// spent once. If the matching payments are not enough, the raiden address
+// payer is served on credit instead. The server stops serving on credit once
+// the unpaid balance of payer would exceed the credit limit, until payer
+// settles it. Charge returns the address that was charged.
+func (s *Server) charge(ctx context.Context, maxTimeout time.Duration, payer string, match func(*receivedPayment) bool, amount *raiden.Amount) (string, bool) {
+	if !s.creditworthy(ctx, payer) {
+		payer = ""
+	}
+	var charged string
+	ok := s.await(ctx, maxTimeout, func() bool {
+		if initiator, ok := s.deduct(match, amount.Int()); ok {
+			charged = initiator
 			return true
 		}
-		// If we reached the timeout -> cancel
-		if time.Since(start) > maxTimeout {
-			break
+		if s.borrow(payer, amount.Int()) {
+			charged = payer
+			return true
+		}
+		return false
+	})
+	return charged, ok
+}
+
+// await waits until pay succeeds within the given timeout. Pay is called
+// with the lock held whenever a new payment was received.
+func (s *Server) await(ctx context.Context, maxTimeout time.Duration, pay func() bool) bool {
+	timeout := time.NewTimer(maxTimeout)
+	defer timeout.Stop()
+	for {
+		s.lock.Lock()
+		if pay() {
+			s.lock.Unlock()
+			return true
 		}
-		// If the context is canceled -> cancel
+		notify := s.notify
+		s.lock.Unlock()
+
+		s.watcher.Wake()
 		select {
+		case <-notify:
+		case <-timeout.C:
+			return false
 		case <-ctx.Done():
-			break
-		default:
-			time.Sleep(pollPause)
+			return false
 		}
 	}
-	return false
 }
 
-func (s *Server) pollHistory() bool {
-	h, err := s.node.PaymentHistory(s.token, s.peer)
-	if err != nil {
+// available returns the unspent value of the matching payments.
+// The lock must be held.
+func (s *Server) available(match func(*receivedPayment) bool) *big.Int {
+	available := new(big.Int)
+	for _, payment := range s.received {
+		if match(payment) {
+			available.Add(available, payment.value)
+		}
+	}
+	return available
+}
+
+// creditworthy returns true if payer may be served on credit. Payers are
+// only known if the server trusts its clients. Even then only configured
+// debtors or, if there are none, customers with an open channel qualify.
+func (s *Server) creditworthy(ctx context.Context, payer string) bool {
+	if s.limit == nil || !s.trusted || payer == "" {
+		return false
+	}
+	if s.peer != "" && !strings.EqualFold(payer, s.peer) {
+		return false
+	}
+	payer = strings.ToLower(payer)
+	if s.debtors != nil {
+		return s.debtors[payer]
+	}
+	s.customerLock.Lock()
+	defer s.customerLock.Unlock()
+	if time.Since(s.customersAt) > customerRefresh {
+		customers, err := s.Customers(ctx)
+		if err != nil {
+			fmt.Printf("could not list customers: %v\n", err)
+			return false
+		}
+		s.customers = make(map[string]bool)
+		for _, customer := range customers {
+			s.customers[strings.ToLower(customer)] = true
+		}
+		s.customersAt = time.Now()
+	}
+	return s.customers[payer]
+}
+
+// borrow adds amount to the unpaid balance of payer if the balance stays
+// within the credit limit. The lock must be held.
+func (s *Server) borrow(payer string, amount *big.Int) bool {
+	if payer == "" {
 		return false
 	}
-	// No new entries in history
-	if len(*h) == len(*s.history) {
+	payer = strings.ToLower(payer)
+	debt := new(big.Int).Set(amount)
+	if d := s.debts[payer]; d != nil {
+		debt.Add(debt, d)
+	} else if len(s.debts) >= maxDebtors {
 		return false
 	}
-	// new entries in history, update history
-	s.history = h
-	a := *h
-	fmt.Printf("Received payment with value %v\n", a[len(a)-1].Amount)
+	if debt.Cmp(s.limit) > 0 {
+		return false
+	}
+	s.debts[payer] = debt
 	return true
 }
+
+// deduct deducts amount from the oldest matching payments and returns
+// the initiator of the payments. The lock must be held.
+func (s *Server) deduct(match func(*receivedPayment) bool, amount *big.Int) (string, bool) {
+	if s.available(match).Cmp(amount) < 0 {
+		return "", false
+	}
+	var initiator string
+	remaining := new(big.Int).Set(amount)
+	for _, payment := range s.received {
+		if remaining.Sign() == 0 {
+			break
+		}
+		if !match(payment) {
+			continue
+		}
+		initiator = payment.initiator
+		if payment.value.Cmp(remaining) >= 0 {
+			payment.value.Sub(payment.value, remaining)
+			remaining.SetInt64(0)
+		} else {
+			remaining.Sub(remaining, payment.value)
+			payment.value.SetInt64(0)
+		}
+	}
+	// Drop the spent payments
+	received := s.received[:0]
+	for _, payment := range s.received {
+		if payment.value.Sign() > 0 {
+			received = append(received, payment)
+		}
+	}
+	s.received = received
+	return initiator, true
+}
@@ -0,0 +1,502 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MariusVanDerWijden/ShareMyRPC/pricing"
+	"github.com/MariusVanDerWijden/ShareMyRPC/raiden"
+	"github.com/MariusVanDerWijden/ShareMyRPC/raidentest"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/gorilla/websocket"
+)
+
+var (
+	token    = "0x95B2d84De40a0121061b105E6B54016a49621B44"
+	provider = "0x1F916ab5cf1B30B22f24Ebf435f53Ee665344Acf"
+	customer = "0x0000000000000000000000000000000000000001"
+)
+
+// newTestProxy starts a proxy in front of a fake node that answers every
+// request with the block number 16. It returns the url of the proxy and
+// the raiden node of the customer.
+func newTestProxy(t *testing.T, opts ...Option) (string, *raiden.Raiden) {
+	network := raidentest.NewNetwork()
+	t.Cleanup(network.Close)
+	us, them := network.NewNode(provider), network.NewNode(customer)
+	network.OpenChannel(token, them, us, pricing.Ether(100).Int(), big.NewInt(0))
+
+	srv, err := NewServer(us.URL(), token, customer, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Close)
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req jsonrpcMessage
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Method == "eth_getBlockByNumber" {
+			fmt.Fprintf(w, `{"jsonrpc":"2.0","id":%s,"error":{"code":-32000,"message":"header not found"}}`, req.ID)
+			return
+		}
+		fmt.Fprintf(w, `{"jsonrpc":"2.0","id":%s,"result":"0x10"}`, req.ID)
+	}))
+	t.Cleanup(node.Close)
+	proxy := httptest.NewServer(NewProxy(srv, node.URL))
+	t.Cleanup(proxy.Close)
+	return proxy.URL, raiden.NewRaiden(them.URL())
+}
+
+func call(t *testing.T, url, method string, id raiden.PaymentID) (int, *jsonrpcMessage) {
+	header := make(http.Header)
+	if id != 0 {
+		header.Set(PaymentIDHeader, id.String())
+	}
+	return callWithHeader(t, url, method, header)
+}
+
+func callWithHeader(t *testing.T, url, method string, header http.Header, params ...interface{}) (int, *jsonrpcMessage) {
+	if params == nil {
+		params = []interface{}{}
+	}
+	encoded, err := json.Marshal(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := fmt.Sprintf(`{"jsonrpc":"2.0","id":1,"method":%q,"params":%s}`, method, encoded)
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key := range header {
+		req.Header.Set(key, header.Get(key))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	msg := new(jsonrpcMessage)
+	if err := json.NewDecoder(resp.Body).Decode(msg); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, msg
+}
+
+// setPaymentTimeout shortens the payment timeout for the duration of the test.
+func setPaymentTimeout(t *testing.T, timeout time.Duration) {
+	old := paymentTimeout
+	paymentTimeout = timeout
+	t.Cleanup(func() { paymentTimeout = old })
+}
+
+func TestProxy(t *testing.T) {
+	setPaymentTimeout(t, 500*time.Millisecond)
+	url, customer := newTestProxy(t)
+
+	// Unpaid requests are rejected
+	if status, msg := call(t, url, "eth_blockNumber", 0); status != http.StatusPaymentRequired || msg.Error == nil {
+		t.Fatalf("unpaid request served: %v %+v", status, msg)
+	}
+	// Free requests are served
+	if status, msg := call(t, url, "eth_chainId", 0); status != http.StatusOK || msg.Error != nil {
+		t.Fatalf("free request not served: %v %+v", status, msg.Error)
+	}
+	// Paid requests are served
+	opts := &raiden.PaymentOptions{Identifier: 7}
+	if _, err := customer.PayToken(token, provider, pricing.DefaultSchedule().Price("eth_blockNumber"), opts); err != nil {
+		t.Fatal(err)
+	}
+	if status, msg := call(t, url, "eth_blockNumber", 8); status != http.StatusPaymentRequired {
+		t.Fatalf("request with wrong payment served: %v %+v", status, msg)
+	}
+	if status, msg := call(t, url, "eth_blockNumber", 7); status != http.StatusOK || string(msg.Result) != `"0x10"` {
+		t.Fatalf("paid request not served: %v %+v", status, msg.Error)
+	}
+	// Payments can only be spent once
+	if status, _ := call(t, url, "eth_blockNumber", 7); status != http.StatusPaymentRequired {
+		t.Fatalf("payment spent twice: %v", status)
+	}
+}
+
+func TestPaymentReceived(t *testing.T) {
+	network := raidentest.NewNetwork()
+	defer network.Close()
+	us, them := network.NewNode(provider), network.NewNode(customer)
+	network.OpenChannel(token, them, us, pricing.Ether(100).Int(), big.NewInt(0))
+	srv, err := NewServer(us.URL(), token, customer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	if srv.PaymentReceived(context.Background(), 100*time.Millisecond) {
+		t.Fatal("payment received without payment")
+	}
+	received := make(chan bool)
+	go func() { received <- srv.PaymentReceived(context.Background(), 5*time.Second) }()
+	time.Sleep(50 * time.Millisecond) // let the waiter start
+	price := pricing.DefaultSchedule().Price("eth_blockNumber")
+	if _, err := raiden.NewRaiden(them.URL()).PayToken(token, provider, price, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !<-received {
+		t.Fatal("payment not received")
+	}
+	// Waiting for the payment does not spend it
+	if credit := srv.Credit(customer); credit.Cmp(price) != 0 {
+		t.Fatalf("payment spent: %v", credit)
+	}
+}
+
+func TestPrices(t *testing.T) {
+	url, _ := newTestProxy(t)
+
+	resp, err := http.Get(url + PricesPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var offer pricing.Offer
+	if err := json.NewDecoder(resp.Body).Decode(&offer); err != nil {
+		t.Fatal(err)
+	}
+	if offer.Token != token || offer.Address != provider || offer.Version != "default" {
+		t.Fatalf("wrong offer: %+v", offer)
+	}
+	if offer.Schedule.Price("eth_call").Cmp(pricing.DefaultSchedule().Price("eth_call")) != 0 {
+		t.Fatalf("wrong schedule: %+v", offer.Schedule)
+	}
+	// The prices are free to query over JSON-RPC
+	status, msg := call(t, url, PricesMethod, 0)
+	if status != http.StatusOK || msg.Error != nil {
+		t.Fatalf("prices not served: %v %+v", status, msg.Error)
+	}
+	var rpcOffer pricing.Offer
+	if err := json.Unmarshal(msg.Result, &rpcOffer); err != nil || rpcOffer.Address != provider {
+		t.Fatalf("wrong offer: %+v %v", rpcOffer, err)
+	}
+}
+
+func TestCredit(t *testing.T) {
+	setPaymentTimeout(t, 500*time.Millisecond)
+	price := pricing.DefaultSchedule().Price("eth_blockNumber")
+	header := make(http.Header)
+	header.Set(PayerHeader, customer)
+
+	// The payer is ignored unless the server trusts its clients
+	url, node := newTestProxy(t)
+	if _, err := node.PayToken(token, provider, price, nil); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := callWithHeader(t, url, "eth_blockNumber", header); status != http.StatusPaymentRequired {
+		t.Fatalf("request paid by untrusted payer: %v", status)
+	}
+
+	url, node = newTestProxy(t, WithTrustedPayers())
+	if status, _ := callWithHeader(t, url, "eth_blockNumber", header); status != http.StatusPaymentRequired {
+		t.Fatalf("request without credit served: %v", status)
+	}
+	deposit := raiden.NewAmount(new(big.Int).Mul(price.Int(), big.NewInt(2)))
+	if _, err := node.PayToken(token, provider, deposit, nil); err != nil {
+		t.Fatal(err)
+	}
+	// Requests without payer can not spend the credit
+	if status, _ := callWithHeader(t, url, "eth_blockNumber", nil); status != http.StatusPaymentRequired {
+		t.Fatalf("request without payer paid from credit: %v", status)
+	}
+	for i := 0; i < 2; i++ {
+		if status, msg := callWithHeader(t, url, "eth_blockNumber", header); status != http.StatusOK {
+			t.Fatalf("request %d not paid from credit: %v %+v", i, status, msg.Error)
+		}
+	}
+	if status, _ := callWithHeader(t, url, "eth_blockNumber", header); status != http.StatusPaymentRequired {
+		t.Fatalf("request served after credit was used up: %v", status)
+	}
+	// Other addresses can not spend the credit
+	if _, err := node.PayToken(token, provider, price, nil); err != nil {
+		t.Fatal(err)
+	}
+	other := make(http.Header)
+	other.Set(PayerHeader, provider)
+	if status, _ := callWithHeader(t, url, "eth_blockNumber", other); status != http.StatusPaymentRequired {
+		t.Fatalf("request paid from foreign credit: %v", status)
+	}
+	status, msg := callWithHeader(t, url, CreditMethod, nil, customer)
+	var credit raiden.Amount
+	if status != http.StatusOK || json.Unmarshal(msg.Result, &credit) != nil || credit.Cmp(price) != 0 {
+		t.Fatalf("wrong credit: %v %s", status, msg.Result)
+	}
+}
+
+// headAPI serves the headers sent on heads to subscribers.
+type headAPI struct {
+	heads chan *types.Header
+}
+
+func (api *headAPI) NewHeads(ctx context.Context) (*rpc.Subscription, error) {
+	notifier, _ := rpc.NotifierFromContext(ctx)
+	sub := notifier.CreateSubscription()
+	go func() {
+		for {
+			select {
+			case header := <-api.heads:
+				notifier.Notify(sub.ID, header)
+			case <-sub.Err():
+				return
+			}
+		}
+	}()
+	return sub, nil
+}
+
+func (api *headAPI) GetBlockByNumber(number rpc.BlockNumber, full bool) (map[string]interface{}, error) {
+	return nil, errors.New("header not found")
+}
+
+func TestPostpaid(t *testing.T) {
+	setPaymentTimeout(t, 500*time.Millisecond)
+	price := pricing.DefaultSchedule().Price("eth_blockNumber")
+	limit := raiden.NewAmount(new(big.Int).Mul(price.Int(), big.NewInt(2)))
+	if _, err := NewServer("http://127.0.0.1:1", token, customer, WithCreditLimit(limit)); err == nil {
+		t.Fatal("credit limit without trusted payers accepted")
+	}
+	url, node := newTestProxy(t, WithTrustedPayers(), WithCreditLimit(limit))
+
+	header := make(http.Header)
+	header.Set(PayerHeader, customer)
+	for i := 0; i < 2; i++ {
+		if status, msg := callWithHeader(t, url, "eth_blockNumber", header); status != http.StatusOK {
+			t.Fatalf("request %d not served on credit: %v %+v", i, status, msg.Error)
+		}
+	}
+	if status, _ := callWithHeader(t, url, "eth_blockNumber", header); status != http.StatusPaymentRequired {
+		t.Fatalf("request over the credit limit served: %v", status)
+	}
+	// Requests without payer or of strangers are never served on credit
+	if status, _ := callWithHeader(t, url, "eth_blockNumber", nil); status != http.StatusPaymentRequired {
+		t.Fatalf("request without payer served on credit: %v", status)
+	}
+	stranger := make(http.Header)
+	stranger.Set(PayerHeader, "0x0000000000000000000000000000000000000042")
+	if status, _ := callWithHeader(t, url, "eth_blockNumber", stranger); status != http.StatusPaymentRequired {
+		t.Fatalf("request of stranger served on credit: %v", status)
+	}
+	// Settling the unpaid balance restores the credit
+	if _, err := node.PayToken(token, provider, limit, nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if status, msg := callWithHeader(t, url, "eth_blockNumber", header); status != http.StatusOK {
+			t.Fatalf("request %d not served after settlement: %v %+v", i, status, msg.Error)
+		}
+	}
+	status, msg := callWithHeader(t, url, CreditMethod, nil, customer)
+	var credit raiden.Amount
+	if status != http.StatusOK || json.Unmarshal(msg.Result, &credit) != nil || credit.Int().Sign() != 0 {
+		t.Fatalf("settlement left credit: %v %s", status, msg.Result)
+	}
+}
+
+func TestDebtors(t *testing.T) {
+	setPaymentTimeout(t, 200*time.Millisecond)
+	header := make(http.Header)
+	header.Set(PayerHeader, customer)
+
+	// Only configured debtors are served on credit
+	url, _ := newTestProxy(t, WithTrustedPayers(), WithCreditLimit(pricing.Ether(100)), WithDebtors("0x0000000000000000000000000000000000000042"))
+	if status, _ := callWithHeader(t, url, "eth_blockNumber", header); status != http.StatusPaymentRequired {
+		t.Fatalf("customer that is no debtor served on credit: %v", status)
+	}
+	url, _ = newTestProxy(t, WithTrustedPayers(), WithCreditLimit(pricing.Ether(100)), WithDebtors(customer))
+	if status, _ := callWithHeader(t, url, "eth_blockNumber", header); status != http.StatusOK {
+		t.Fatalf("debtor not served on credit: %v", status)
+	}
+	// No more debtors than the maximum are served
+	oldMax := maxDebtors
+	maxDebtors = 0
+	t.Cleanup(func() { maxDebtors = oldMax })
+	url, _ = newTestProxy(t, WithTrustedPayers(), WithCreditLimit(pricing.Ether(100)))
+	if status, _ := callWithHeader(t, url, "eth_blockNumber", header); status != http.StatusPaymentRequired {
+		t.Fatalf("debtor over the maximum served on credit: %v", status)
+	}
+}
+
+func TestRefund(t *testing.T) {
+	setPaymentTimeout(t, 500*time.Millisecond)
+	url, node := newTestProxy(t, WithTrustedPayers())
+	price := pricing.DefaultSchedule().Price("eth_getBlockByNumber")
+
+	header := make(http.Header)
+	header.Set(PayerHeader, customer)
+	if _, err := node.PayToken(token, provider, price, nil); err != nil {
+		t.Fatal(err)
+	}
+	if status, msg := callWithHeader(t, url, "eth_getBlockByNumber", header, "0x1", false); status != http.StatusOK || msg.Error == nil {
+		t.Fatalf("expected error of the node: %v %+v", status, msg)
+	}
+	// The failed request is credited to the payer
+	status, msg := callWithHeader(t, url, CreditMethod, nil, customer)
+	var credit raiden.Amount
+	if status != http.StatusOK || json.Unmarshal(msg.Result, &credit) != nil || credit.Cmp(price) != 0 {
+		t.Fatalf("failed request not refunded: %v %s", status, msg.Result)
+	}
+	if status, msg := callWithHeader(t, url, "eth_blockNumber", header); status != http.StatusOK {
+		t.Fatalf("request not paid from refund: %v %+v", status, msg.Error)
+	}
+	if status, _ := callWithHeader(t, url, "eth_blockNumber", header); status != http.StatusPaymentRequired {
+		t.Fatalf("refund spent twice: %v", status)
+	}
+
+	// Requests paid by identifier are refunded to the initiator of the payment
+	opts := &raiden.PaymentOptions{Identifier: 9}
+	if _, err := node.PayToken(token, provider, price, opts); err != nil {
+		t.Fatal(err)
+	}
+	idHeader := make(http.Header)
+	idHeader.Set(PaymentIDHeader, "9")
+	if status, msg := callWithHeader(t, url, "eth_getBlockByNumber", idHeader, "0x1", false); status != http.StatusOK || msg.Error == nil {
+		t.Fatalf("expected error of the node: %v %+v", status, msg)
+	}
+	if status, _ := callWithHeader(t, url, "eth_blockNumber", nil); status != http.StatusPaymentRequired {
+		t.Fatalf("refund spent by request without payer: %v", status)
+	}
+	// Requests rejected by the node are not refunded
+	if _, err := node.PayToken(token, provider, price, nil); err != nil {
+		t.Fatal(err)
+	}
+	if status, msg := callWithHeader(t, url, "eth_getBlockByNumber", header); status != http.StatusOK || msg.Error == nil {
+		t.Fatalf("expected invalid params: %v %+v", status, msg)
+	}
+	if status, msg := callWithHeader(t, url, CreditMethod, nil, customer); status != http.StatusOK || string(msg.Result) != `"`+price.String()+`"` {
+		t.Fatalf("rejected request refunded: %v %s", status, msg.Result)
+	}
+	// Batches with duplicate request ids are refused
+	body := `[{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber","params":[]},{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber","params":[]}]`
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(PayerHeader, customer)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("duplicate ids accepted: %v", resp.StatusCode)
+	}
+	// Refunds can not be spent by identifier
+	for _, id := range []string{"0", `""`} {
+		header := make(http.Header)
+		header.Set(PaymentIDHeader, id)
+		if status, _ := callWithHeader(t, url, "eth_blockNumber", header); status != http.StatusBadRequest {
+			t.Fatalf("identifier %s accepted: %v", id, status)
+		}
+	}
+	if status, msg := callWithHeader(t, url, "eth_blockNumber", header); status != http.StatusOK {
+		t.Fatalf("request not paid from refund: %v %+v", status, msg.Error)
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	setPaymentTimeout(t, 500*time.Millisecond)
+	network := raidentest.NewNetwork()
+	defer network.Close()
+	us, them := network.NewNode(provider), network.NewNode(customer)
+	network.OpenChannel(token, them, us, pricing.Ether(100).Int(), big.NewInt(0))
+	srv, err := NewServer(us.URL(), token, customer, WithTrustedPayers())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	api := &headAPI{heads: make(chan *types.Header)}
+	node := rpc.NewServer()
+	if err := node.RegisterName("eth", api); err != nil {
+		t.Fatal(err)
+	}
+	nodeServer := httptest.NewServer(node.WebsocketHandler([]string{"*"}))
+	defer nodeServer.Close()
+	proxy := httptest.NewServer(NewProxy(srv, nodeServer.URL, WithNodeWebSocket("ws"+strings.TrimPrefix(nodeServer.URL, "http"))))
+	defer proxy.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(proxy.URL, "http")+"?"+PayerParam+"="+customer, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// Pay for the subscription and a single notification
+	schedule := pricing.DefaultSchedule()
+	price := schedule.Total(pricing.SubscriptionMethod("newHeads"), pricing.NotificationMethod("newHeads"))
+	if _, err := raiden.NewRaiden(them.URL()).PayToken(token, provider, price, nil); err != nil {
+		t.Fatal(err)
+	}
+	// Connections of other payers can not spend the payment
+	other, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(proxy.URL, "http")+"?"+PayerParam+"="+provider, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	other.SetReadDeadline(time.Now().Add(5 * time.Second))
+	subscribe := map[string]interface{}{"jsonrpc": "2.0", "id": 1, "method": "eth_subscribe", "params": []string{"newHeads"}}
+	if err := other.WriteJSON(subscribe); err != nil {
+		t.Fatal(err)
+	}
+	var failed jsonrpcMessage
+	if err := other.ReadJSON(&failed); err != nil || failed.Error == nil || failed.Error.Code != errcodePaymentMissing {
+		t.Fatalf("subscription paid by foreign payment: %v %+v", err, failed)
+	}
+	if err := conn.WriteJSON(subscribe); err != nil {
+		t.Fatal(err)
+	}
+	var msg jsonrpcMessage
+	if err := conn.ReadJSON(&msg); err != nil || msg.Error != nil {
+		t.Fatalf("subscription failed: %v %+v", err, msg.Error)
+	}
+	header := &types.Header{Number: big.NewInt(1), Difficulty: big.NewInt(1)}
+	api.heads <- header
+	if err := conn.ReadJSON(&msg); err != nil || msg.Method != notificationMethod {
+		t.Fatalf("paid notification not delivered: %v %+v", err, msg)
+	}
+	// The connection is closed instead of delivering an unpaid notification
+	api.heads <- header
+	err = conn.ReadJSON(&msg)
+	if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Fatalf("expected connection to be closed, got %v %+v", err, msg)
+	}
+
+	// Requests the node fails to serve are refunded to the payer
+	conn, _, err = websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(proxy.URL, "http")+"?"+PayerParam+"="+customer, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	price = schedule.Price("eth_getBlockByNumber")
+	if _, err := raiden.NewRaiden(them.URL()).PayToken(token, provider, price, nil); err != nil {
+		t.Fatal(err)
+	}
+	request := map[string]interface{}{"jsonrpc": "2.0", "id": 2, "method": "eth_getBlockByNumber", "params": []interface{}{"0x1", false}}
+	if err := conn.WriteJSON(request); err != nil {
+		t.Fatal(err)
+	}
+	var answer jsonrpcMessage
+	if err := conn.ReadJSON(&answer); err != nil || answer.Error == nil || answer.Error.Code == errcodePaymentMissing {
+		t.Fatalf("expected error of the node: %v %+v", err, answer.Error)
+	}
+	if credit := srv.Credit(customer); credit.Cmp(price) != 0 {
+		t.Fatalf("failed request not refunded: %v", credit)
+	}
+}
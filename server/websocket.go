@@ -0,0 +1,317 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/MariusVanDerWijden/ShareMyRPC/pricing"
+	"github.com/MariusVanDerWijden/ShareMyRPC/raiden"
+	"github.com/gorilla/websocket"
+)
+
+// JSON-RPC methods of subscriptions.
+const (
+	subscribeMethod    = "eth_subscribe"
+	unsubscribeMethod  = "eth_unsubscribe"
+	notificationMethod = "eth_subscription"
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	// Customers are programs, not browsers
+	CheckOrigin: func(*http.Request) bool { return true },
+}
+
+var errPaymentMissing = errors.New("payment missing")
+
+// wsConn is a websocket connection of a customer that is forwarded to the node.
+//
+// Calls are paid for like HTTP requests. Every notification of a subscription
+// is only delivered after its price was received, and open subscriptions are
+// charged again every period of the schedule. Since headers can not be set
+// per message, payments are taken from the credit of the payer in the
+// handshake headers or query, if the server trusts its clients. Connections
+// without payer can only pay by payments without initiator. A payer may be served on credit up to the
+// credit limit of the server. The connection is closed if a payment for a
+// subscription is missing. Paid requests the node fails to serve are
+// refunded like HTTP requests, but without telling the client.
+type wsConn struct {
+	proxy  *Proxy
+	client *websocket.Conn
+	node   *websocket.Conn
+	payer  string // raiden address of the client, empty if unknown
+	match  func(*receivedPayment) bool
+
+	writeLock sync.Mutex // writes to the client
+
+	lock    sync.Mutex
+	pending map[string]string          // kind of subscriptions by request id
+	paid    map[string]*wsPaidRequest  // unanswered paid requests by id
+	subs    map[string]*wsSubscription // open subscriptions by id
+	errc    chan error                 // first error ends the connection
+}
+
+// wsPaidRequest is refunded if the node fails to serve it.
+type wsPaidRequest struct {
+	charged string // address charged for the request
+	cost    *raiden.Amount
+}
+
+type wsSubscription struct {
+	kind string
+	quit chan struct{}
+}
+
+func (p *Proxy) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	if p.wsURL == "" {
+		http.Error(w, "websocket not supported", http.StatusNotImplemented)
+		return
+	}
+	node, _, err := websocket.DefaultDialer.DialContext(r.Context(), p.wsURL, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	client, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		node.Close()
+		return
+	}
+	client.SetReadLimit(maxRequestSize)
+	c := &wsConn{
+		proxy:   p,
+		client:  client,
+		node:    node,
+		payer:   p.payerOf(r),
+		match:   p.payerMatch(r),
+		pending: make(map[string]string),
+		paid:    make(map[string]*wsPaidRequest),
+		subs:    make(map[string]*wsSubscription),
+		errc:    make(chan error, 2),
+	}
+	c.run()
+}
+
+// run forwards messages in both directions until either side fails.
+func (c *wsConn) run() {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() { c.errc <- c.readClient(ctx) }()
+	go func() { c.errc <- c.readNode(ctx) }()
+	err := <-c.errc
+	cancel()
+
+	if errors.Is(err, errPaymentMissing) {
+		c.writeLock.Lock()
+		msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error())
+		c.client.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		c.writeLock.Unlock()
+	}
+	c.client.Close()
+	c.node.Close()
+
+	c.lock.Lock()
+	for id, sub := range c.subs {
+		close(sub.quit)
+		delete(c.subs, id)
+	}
+	c.lock.Unlock()
+}
+
+// readClient forwards the paid messages of the client to the node.
+func (c *wsConn) readClient(ctx context.Context) error {
+	for {
+		_, data, err := c.client.ReadMessage()
+		if err != nil {
+			return err
+		}
+		msgs, err := parseMessages(data)
+		if err == nil {
+			err = checkIDs(msgs)
+		}
+		if err != nil {
+			c.write(errorMessage(nil, errcodeInvalidRequest, err.Error()))
+			continue
+		}
+		if len(msgs) == 1 {
+			if result, jsonErr, ok := c.proxy.local(msgs[0]); ok {
+				if jsonErr != nil {
+					c.write(errorMessage(msgs[0].ID, jsonErr.Code, jsonErr.Message))
+				} else if msg, err := resultMessage(msgs[0].ID, result); err != nil {
+					c.write(errorMessage(msgs[0].ID, errcodeInternal, err.Error()))
+				} else {
+					c.write(msg)
+				}
+				continue
+			}
+		}
+		if err := c.checkPending(msgs); err != nil {
+			c.write(errorMessage(msgs[0].ID, errcodeInvalidRequest, err.Error()))
+			continue
+		}
+		cost := c.proxy.cost(msgs)
+		charged, ok := c.pay(ctx, cost)
+		if !ok {
+			c.write(errorMessage(msgs[0].ID, errcodePaymentMissing, fmt.Sprintf("payment of %v not received", cost)))
+			continue
+		}
+		c.lock.Lock()
+		for _, msg := range msgs {
+			if msg.ID != nil {
+				if cost := c.proxy.cost([]*jsonrpcMessage{msg}); cost.Int().Sign() > 0 {
+					c.paid[string(msg.ID)] = &wsPaidRequest{charged: charged, cost: cost}
+				}
+			}
+			switch msg.Method {
+			case subscribeMethod:
+				c.pending[string(msg.ID)] = subscriptionKind(msg)
+			case unsubscribeMethod:
+				var params []string
+				if json.Unmarshal(msg.Params, &params) == nil && len(params) > 0 {
+					if sub, ok := c.subs[params[0]]; ok {
+						close(sub.quit)
+						delete(c.subs, params[0])
+					}
+				}
+			}
+		}
+		c.lock.Unlock()
+		if err := c.node.WriteMessage(websocket.TextMessage, data); err != nil {
+			return err
+		}
+	}
+}
+
+// checkPending returns an error if a message reuses the id of a paid
+// request that was not answered yet, since the answers could not be told
+// apart.
+func (c *wsConn) checkPending(msgs []*jsonrpcMessage) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, msg := range msgs {
+		if msg.ID == nil {
+			continue
+		}
+		if _, ok := c.paid[string(msg.ID)]; ok {
+			return fmt.Errorf("duplicate request id %s", msg.ID)
+		}
+	}
+	return nil
+}
+
+// readNode forwards the messages of the node to the client. Notifications
+// are only forwarded after their price was received. Paid requests the node
+// failed to serve are refunded to the credit of whoever was charged.
+func (c *wsConn) readNode(ctx context.Context) error {
+	for {
+		_, data, err := c.node.ReadMessage()
+		if err != nil {
+			return err
+		}
+		msgs, err := parseMessages(data)
+		if err != nil {
+			return err
+		}
+		for _, msg := range msgs {
+			if msg.Method == notificationMethod {
+				if err := c.chargeNotification(ctx, msg); err != nil {
+					return err
+				}
+				continue
+			}
+			c.lock.Lock()
+			kind, ok := c.pending[string(msg.ID)]
+			delete(c.pending, string(msg.ID))
+			paid := c.paid[string(msg.ID)]
+			delete(c.paid, string(msg.ID))
+			c.lock.Unlock()
+			if paid != nil && nodeFailed(msg) {
+				c.proxy.server.refund(paid.charged, paid.cost.Int())
+			}
+			var id string
+			if ok && msg.Error == nil && json.Unmarshal(msg.Result, &id) == nil {
+				c.subscribed(ctx, id, kind)
+			}
+		}
+		c.writeLock.Lock()
+		err = c.client.WriteMessage(websocket.TextMessage, data)
+		c.writeLock.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// chargeNotification waits for the price of a notification.
+func (c *wsConn) chargeNotification(ctx context.Context, msg *jsonrpcMessage) error {
+	var params struct {
+		Subscription string `json:"subscription"`
+	}
+	json.Unmarshal(msg.Params, &params)
+	c.lock.Lock()
+	sub, ok := c.subs[params.Subscription]
+	c.lock.Unlock()
+	if !ok {
+		return nil
+	}
+	price := c.proxy.server.schedule.Price(pricing.NotificationMethod(sub.kind))
+	if _, ok := c.pay(ctx, price); !ok {
+		return fmt.Errorf("%w: notification of subscription %v", errPaymentMissing, params.Subscription)
+	}
+	return nil
+}
+
+// subscribed records a new subscription and charges it every period.
+func (c *wsConn) subscribed(ctx context.Context, id, kind string) {
+	sub := &wsSubscription{kind: kind, quit: make(chan struct{})}
+	c.lock.Lock()
+	c.subs[id] = sub
+	c.lock.Unlock()
+
+	period := c.proxy.server.schedule.SubscriptionPeriod()
+	if period == 0 {
+		return
+	}
+	price := c.proxy.server.schedule.Price(pricing.SubscriptionMethod(kind))
+	go func() {
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if _, ok := c.pay(ctx, price); !ok {
+					select {
+					case c.errc <- fmt.Errorf("%w: period of subscription %v", errPaymentMissing, id):
+					default:
+					}
+					return
+				}
+			case <-sub.quit:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// pay waits until amount is paid by the client. It returns the address
+// that was charged.
+func (c *wsConn) pay(ctx context.Context, amount *raiden.Amount) (string, bool) {
+	if amount.Int().Sign() == 0 {
+		return c.payer, true
+	}
+	return c.proxy.server.charge(ctx, paymentTimeout, c.payer, c.match, amount)
+}
+
+// write sends a message to the client.
+func (c *wsConn) write(msg *jsonrpcMessage) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	c.client.WriteJSON(msg)
+}